@@ -250,7 +250,11 @@ func DoRequest(L *lua.LState) int {
 	client := checkClient(L)
 	req := checkRequest(L, 2)
 
-	response, err := client.DoRequest(req.Request)
+	httpReq := req.Request
+	if ctx := L.Context(); ctx != nil {
+		httpReq = httpReq.WithContext(ctx)
+	}
+	response, err := send(httpReq, client.DoRequest)
 	if err != nil {
 		L.RaiseError("%v", err)
 	}
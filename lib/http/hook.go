@@ -0,0 +1,41 @@
+package http
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Sender sends a request.
+type Sender func(req *http.Request) (*http.Response, error)
+
+// Middleware wraps the sending of a request, e.g. to add headers or to time
+// it. Requests carry the context of the calling state.
+type Middleware func(req *http.Request, next Sender) (*http.Response, error)
+
+var (
+	middleware     []Middleware
+	middlewareLock = &sync.RWMutex{}
+)
+
+// Use wraps every request sent by clients in m. Middleware added first runs
+// first.
+func Use(m Middleware) {
+	middlewareLock.Lock()
+	defer middlewareLock.Unlock()
+
+	middleware = append(middleware, m)
+}
+
+// send sends req through the middleware.
+func send(req *http.Request, do Sender) (*http.Response, error) {
+	middlewareLock.RLock()
+	ms := middleware
+	middlewareLock.RUnlock()
+	for i := len(ms) - 1; i >= 0; i-- {
+		m, next := ms[i], do
+		do = func(req *http.Request) (*http.Response, error) {
+			return m(req, next)
+		}
+	}
+	return do(req)
+}
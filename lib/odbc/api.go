@@ -5,14 +5,17 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/yuin/gluamapper"
 	lua "github.com/yuin/gopher-lua"
 )
 
 const (
-	// max open connections
+	// max open connections of in-memory sqlite databases, which exist once
+	// per connection
 	MaxOpenConns = 1
 )
 
@@ -21,21 +24,92 @@ type luaDB interface {
 	getDB() *sql.DB
 	closeDB() error
 	getTXOptions() *sql.TxOptions
+	driverName() string
+	getTypes() Types
+	getTimeout() time.Duration
+	getHooks() *luaHooks
 }
 
 type Config struct {
-	Driver         string
-	ConnString     string
-	Shared         bool
+	Driver     string
+	ConnString string
+	Shared     bool
+	// open connections, 0 for no limit
 	MaxConnections int
-	ReadOnly       bool
+	// idle connections kept, 0 for the default of database/sql, -1 for none
+	MaxIdle int
+	// seconds a connection is reused and may be idle, 0 for no limit
+	ConnMaxLifetime float64
+	ConnMaxIdleTime float64
+	// fail to open if the database cannot be reached
+	Ping     bool
+	ReadOnly bool
+	Types    Types
+	// seconds a call may run, 0 for no limit
+	Timeout float64
 }
 
 type dbConfig struct {
-	connString   string
-	sharedMode   bool
-	maxOpenConns int
-	readOnly     bool
+	connString string
+	sharedMode bool
+	pool       Config
+	readOnly   bool
+	types      Types
+	hooks      *luaHooks
+}
+
+// setupDB applies the pool settings to a newly opened database and pings
+// it if asked to.
+func setupDB(db *sql.DB, config *dbConfig) error {
+	pool := config.pool
+	if pool.Driver == `sqlite3` && isMemory(config.connString) {
+		// the data is lost with the connection holding it
+		if pool.MaxIdle < 0 || pool.ConnMaxLifetime > 0 || pool.ConnMaxIdleTime > 0 {
+			db.Close()
+			return fmt.Errorf("in-memory sqlite databases lose their data when connections are closed, max_idle must not be negative and conn_max_lifetime and conn_max_idle_time must be 0")
+		}
+		if pool.MaxConnections == 0 {
+			pool.MaxConnections = MaxOpenConns
+		}
+	}
+	db.SetMaxOpenConns(pool.MaxConnections)
+	if pool.MaxIdle != 0 {
+		db.SetMaxIdleConns(max(pool.MaxIdle, 0))
+	}
+	db.SetConnMaxLifetime(time.Duration(pool.ConnMaxLifetime * float64(time.Second)))
+	db.SetConnMaxIdleTime(time.Duration(pool.ConnMaxIdleTime * float64(time.Second)))
+	if pool.Ping {
+		if err := db.Ping(); err != nil {
+			db.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// InMemory reports whether c is an in-memory sqlite database, which exists
+// only in the process opening it.
+func InMemory(c Config) bool {
+	return c.Driver == `sqlite3` && isMemory(c.ConnString)
+}
+
+// samePool checks that a database opened again in shared mode asks for
+// the pool it shares, whose settings are those of its first opening. The
+// types, timeout and hooks belong to each opening.
+func samePool(open, c *dbConfig) error {
+	a, b := open.pool, c.pool
+	if a.MaxConnections != b.MaxConnections || a.MaxIdle != b.MaxIdle ||
+		a.ConnMaxLifetime != b.ConnMaxLifetime || a.ConnMaxIdleTime != b.ConnMaxIdleTime {
+		return fmt.Errorf("%s database is already open in shared mode with other pool settings", b.Driver)
+	}
+	return nil
+}
+
+// isMemory reports whether a sqlite connection string is an in-memory
+// database.
+func isMemory(connString string) bool {
+	return connString == ":memory:" || strings.HasPrefix(connString, "file::memory:") ||
+		strings.Contains(connString, "mode=memory")
 }
 
 var (
@@ -65,8 +139,14 @@ func checkDB(L *lua.LState, n int) luaDB {
 //
 //	{
 //	  shared=false,
-//	  max_connections=X,
-//	  read_only=false
+//	  max_connections=0,
+//	  max_idle=0,
+//	  conn_max_lifetime=0,
+//	  conn_max_idle_time=0,
+//	  ping=false,
+//	  read_only=false,
+//	  timeout=0,
+//	  types={time="rfc3339", decimal="string", json="table", bigint="string"}
 //	}
 func LuaOpen(L *lua.LState) int {
 	driver := L.CheckString(1)
@@ -74,7 +154,7 @@ func LuaOpen(L *lua.LState) int {
 	var c Config
 	if L.GetTop() > 2 {
 		config := L.CheckTable(3)
-		if err := gluamapper.Map(config, c); err != nil {
+		if err := gluamapper.Map(config, &c); err != nil {
 			L.RaiseError("%v", err)
 		}
 	}
@@ -103,10 +183,18 @@ func Open(c Config) (luaDB, error) {
 
 	// parse config
 	config := &dbConfig{
-		connString:   c.ConnString,
-		sharedMode:   c.Shared,
-		maxOpenConns: c.MaxConnections,
-		readOnly:     c.ReadOnly,
+		connString: c.ConnString,
+		sharedMode: c.Shared,
+		pool:       c,
+		readOnly:   c.ReadOnly,
+		types:      c.Types,
+		hooks:      &luaHooks{},
+	}
+	if err := c.Types.Check(); err != nil {
+		return nil, err
+	}
+	if c.Timeout < 0 {
+		return nil, fmt.Errorf("timeout must not be negative")
 	}
 
 	dbIface, err := db.constructor(config)
@@ -117,78 +205,176 @@ func Open(c Config) (luaDB, error) {
 	return dbIface, nil
 }
 
-// Query lua db_ud:query(query) returns {rows = {}, columns = {}}
+// CloseDB closes the database opened in shared mode with c, so that it is
+// opened again when it is used next.
+func CloseDB(c Config) error {
+	db, err := Open(c)
+	if err != nil {
+		return err
+	}
+	return db.closeDB()
+}
+
+// OpenDB is like Open but returns the database itself, e.g. to use a
+// database opened in shared mode from Go.
+func OpenDB(c Config) (*sql.DB, error) {
+	db, err := Open(c)
+	if err != nil {
+		return nil, err
+	}
+	return db.getDB(), nil
+}
+
+// Query lua db_ud:query(query, ...) returns {rows = {}, columns = {}}
+// The arguments bind ? placeholders in order, or :name and @name
+// parameters if a single table with names is passed. On postgres, write
+// the jsonb ? operator as ?? in queries with ? placeholders. The query may
+// be a table that also sets the types of the results and the timeout of
+// the call in seconds, {"select ...", time="unix", timeout=1.5}.
 func Query(L *lua.LState) int {
 	dbInterface := checkDB(L, 1)
-	query := L.CheckString(2)
+	query, types := checkQuery(L, 2, dbInterface.getTypes())
+	timeout := checkTimeout(L, 2, dbInterface.getTimeout())
+	query, args := bindArgs(L, dbInterface.driverName(), query, 3)
+	ob := observe(L, dbInterface.getHooks(), "query", query, len(args))
+	defer ob.done()
+	ctx, cancel := callContext(L, timeout)
+	defer cancel()
 	sqlDB := dbInterface.getDB()
+	checkFree(L, sqlDB)
 	opts := dbInterface.getTXOptions()
-	tx, err := sqlDB.BeginTx(context.Background(), opts)
+	tx, err := sqlDB.BeginTx(ctx, opts)
 	if err != nil {
-		L.RaiseError("%v", err)
+		raise(L, ctx, err)
 	}
 	defer tx.Rollback()
-	sqlRows, err := tx.Query(query)
-	if err != nil {
-		L.RaiseError("%v", err)
-	}
-	defer sqlRows.Close()
-	rows, columns, err := parseRows(sqlRows, L)
-	if err != nil {
-		L.RaiseError("%v", err)
+	L.Push(runQuery(L, ob, ctx, tx, query, args, types))
+	if err := tx.Commit(); err != nil {
+		raise(L, ctx, err)
 	}
-	tx.Commit()
-	result := L.NewTable()
-	result.RawSetString(`rows`, rows)
-	result.RawSetString(`columns`, columns)
-	L.Push(result)
 	return 1
 }
 
-// Exec lua db_ud:exec(query) returns {rows_affected=number, last_insert_id=number}
+// Exec lua db_ud:exec(query, ...) returns {rows_affected=number, last_insert_id=number}
 func Exec(L *lua.LState) int {
 	dbInterface := checkDB(L, 1)
-	query := L.CheckString(2)
+	query, _ := checkQuery(L, 2, dbInterface.getTypes())
+	timeout := checkTimeout(L, 2, dbInterface.getTimeout())
+	query, args := bindArgs(L, dbInterface.driverName(), query, 3)
+	ob := observe(L, dbInterface.getHooks(), "exec", query, len(args))
+	defer ob.done()
+	ctx, cancel := callContext(L, timeout)
+	defer cancel()
 	sqlDB := dbInterface.getDB()
+	checkFree(L, sqlDB)
 	opts := dbInterface.getTXOptions()
-	tx, err := sqlDB.BeginTx(context.Background(), opts)
+	tx, err := sqlDB.BeginTx(ctx, opts)
 	if err != nil {
-		L.RaiseError("%v", err)
+		raise(L, ctx, err)
 	}
 	defer tx.Rollback()
-	sqlResult, err := tx.Exec(query)
-	if err != nil {
-		L.RaiseError("%v", err)
-	}
-	tx.Commit()
-	result := L.NewTable()
-	if id, err := sqlResult.LastInsertId(); err == nil {
-		result.RawSetString(`last_insert_id`, lua.LNumber(id))
-	}
-	if aff, err := sqlResult.RowsAffected(); err == nil {
-		result.RawSetString(`rows_affected`, lua.LNumber(aff))
+	L.Push(runExec(L, ob, ctx, tx, query, args))
+	if err := tx.Commit(); err != nil {
+		raise(L, ctx, err)
 	}
-	L.Push(result)
 	return 1
 }
 
-// Command lua db_ud:command(query) returns {rows = {}, columns = {}}
+// Command lua db_ud:command(query, ...) returns {rows = {}, columns = {}}
 func Command(L *lua.LState) int {
 	dbInterface := checkDB(L, 1)
-	query := L.CheckString(2)
+	query, types := checkQuery(L, 2, dbInterface.getTypes())
+	timeout := checkTimeout(L, 2, dbInterface.getTimeout())
+	query, args := bindArgs(L, dbInterface.driverName(), query, 3)
+	ob := observe(L, dbInterface.getHooks(), "command", query, len(args))
+	defer ob.done()
+	ctx, cancel := callContext(L, timeout)
+	defer cancel()
 	sqlDB := dbInterface.getDB()
-	sqlRows, err := sqlDB.Query(query)
+	checkFree(L, sqlDB)
+	L.Push(runQuery(L, ob, ctx, sqlDB, query, args, types))
+	return 1
+}
+
+// queryer runs statements, a database or a transaction.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// runQuery returns the {rows = {}, columns = {}} of a query, observed by
+// ob.
+func runQuery(L *lua.LState, ob *observation, ctx context.Context, q queryer, query string, args []any, types Types) *lua.LTable {
+	sqlRows, err := q.QueryContext(ctx, query, args...)
 	if err != nil {
-		L.RaiseError("%v", err)
+		raise(L, ctx, err)
+	}
+	result := rowsResult(L, ctx, sqlRows, types)
+	ob.result(result)
+	return result
+}
+
+// runExec returns the {rows_affected=number, last_insert_id=number} of a
+// statement, observed by ob.
+func runExec(L *lua.LState, ob *observation, ctx context.Context, q queryer, query string, args []any) *lua.LTable {
+	sqlResult, err := q.ExecContext(ctx, query, args...)
+	if err != nil {
+		raise(L, ctx, err)
 	}
+	result := execResult(L, sqlResult)
+	ob.result(result)
+	return result
+}
+
+func rowsResult(L *lua.LState, ctx context.Context, sqlRows *sql.Rows, types Types) *lua.LTable {
 	defer sqlRows.Close()
-	rows, columns, err := parseRows(sqlRows, L)
+	rows, columns, err := parseRows(L, sqlRows, types)
 	if err != nil {
-		L.RaiseError("%v", err)
+		raise(L, ctx, err)
 	}
 	result := L.NewTable()
 	result.RawSetString(`rows`, rows)
 	result.RawSetString(`columns`, columns)
+	return result
+}
+
+func execResult(L *lua.LState, sqlResult sql.Result) *lua.LTable {
+	result := L.NewTable()
+	if id, err := sqlResult.LastInsertId(); err == nil {
+		result.RawSetString(`last_insert_id`, lua.LNumber(id))
+	}
+	if aff, err := sqlResult.RowsAffected(); err == nil {
+		result.RawSetString(`rows_affected`, lua.LNumber(aff))
+	}
+	return result
+}
+
+// Stats lua db_ud:stats() returns the statistics of the connection pool
+//
+//	{
+//	  max_open_connections=0,
+//	  open_connections=1,
+//	  in_use=0,
+//	  idle=1,
+//	  wait_count=0,
+//	  wait_duration=0, -- seconds
+//	  max_idle_closed=0,
+//	  max_idle_time_closed=0,
+//	  max_lifetime_closed=0
+//	}
+func Stats(L *lua.LState) int {
+	stats := checkDB(L, 1).getDB().Stats()
+	result := L.CreateTable(0, 9)
+	result.RawSetString(`max_open_connections`, lua.LNumber(stats.MaxOpenConnections))
+	result.RawSetString(`open_connections`, lua.LNumber(stats.OpenConnections))
+	result.RawSetString(`in_use`, lua.LNumber(stats.InUse))
+	result.RawSetString(`idle`, lua.LNumber(stats.Idle))
+	result.RawSetString(`wait_count`, lua.LNumber(stats.WaitCount))
+	result.RawSetString(`wait_duration`, lua.LNumber(stats.WaitDuration.Seconds()))
+	result.RawSetString(`max_idle_closed`, lua.LNumber(stats.MaxIdleClosed))
+	result.RawSetString(`max_idle_time_closed`, lua.LNumber(stats.MaxIdleTimeClosed))
+	result.RawSetString(`max_lifetime_closed`, lua.LNumber(stats.MaxLifetimeClosed))
 	L.Push(result)
 	return 1
 }
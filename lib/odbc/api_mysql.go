@@ -3,6 +3,7 @@ package odbc
 import (
 	"database/sql"
 	"sync"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -27,9 +28,11 @@ func (mysql *luaMySQL) constructor(config *dbConfig) (luaDB, error) {
 	defer sharedMySQLLock.Unlock()
 
 	if config.sharedMode {
-		result, ok := sharedMySQL[config.connString]
-		if ok {
-			return result, nil
+		if shared, ok := sharedMySQL[config.connString]; ok {
+			if err := samePool(shared.config, config); err != nil {
+				return nil, err
+			}
+			return &luaMySQL{config: config, db: shared.db}, nil
 		}
 	}
 
@@ -38,8 +41,9 @@ func (mysql *luaMySQL) constructor(config *dbConfig) (luaDB, error) {
 		return nil, err
 	}
 	result := &luaMySQL{config: config}
-	db.SetMaxIdleConns(config.maxOpenConns)
-	db.SetMaxOpenConns(config.maxOpenConns)
+	if err := setupDB(db, config); err != nil {
+		return nil, err
+	}
 	result.db = db
 
 	if config.sharedMode {
@@ -49,12 +53,28 @@ func (mysql *luaMySQL) constructor(config *dbConfig) (luaDB, error) {
 	return result, nil
 }
 
+func (mysql *luaMySQL) driverName() string {
+	return `mysql`
+}
+
 func (mysql *luaMySQL) getDB() *sql.DB {
 	mysql.Lock()
 	defer mysql.Unlock()
 	return mysql.db
 }
 
+func (mysql *luaMySQL) getTypes() Types {
+	return mysql.config.types
+}
+
+func (mysql *luaMySQL) getTimeout() time.Duration {
+	return seconds(mysql.config.pool.Timeout)
+}
+
+func (mysql *luaMySQL) getHooks() *luaHooks {
+	return mysql.config.hooks
+}
+
 func (mysql *luaMySQL) getTXOptions() *sql.TxOptions {
 	return &sql.TxOptions{ReadOnly: mysql.config.readOnly}
 }
@@ -3,6 +3,7 @@ package odbc
 import (
 	"database/sql"
 	"sync"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -27,9 +28,11 @@ func (pg *luaPG) constructor(config *dbConfig) (luaDB, error) {
 	defer sharedPGLock.Unlock()
 
 	if config.sharedMode {
-		result, ok := sharedPG[config.connString]
-		if ok {
-			return result, nil
+		if shared, ok := sharedPG[config.connString]; ok {
+			if err := samePool(shared.config, config); err != nil {
+				return nil, err
+			}
+			return &luaPG{config: config, db: shared.db}, nil
 		}
 	}
 
@@ -38,8 +41,9 @@ func (pg *luaPG) constructor(config *dbConfig) (luaDB, error) {
 		return nil, err
 	}
 	result := &luaPG{config: config}
-	db.SetMaxIdleConns(config.maxOpenConns)
-	db.SetMaxOpenConns(config.maxOpenConns)
+	if err := setupDB(db, config); err != nil {
+		return nil, err
+	}
 	result.db = db
 
 	if config.sharedMode {
@@ -49,10 +53,26 @@ func (pg *luaPG) constructor(config *dbConfig) (luaDB, error) {
 	return result, nil
 }
 
+func (pg *luaPG) getTypes() Types {
+	return pg.config.types
+}
+
+func (pg *luaPG) getTimeout() time.Duration {
+	return seconds(pg.config.pool.Timeout)
+}
+
+func (pg *luaPG) getHooks() *luaHooks {
+	return pg.config.hooks
+}
+
 func (pg *luaPG) getTXOptions() *sql.TxOptions {
 	return &sql.TxOptions{ReadOnly: pg.config.readOnly}
 }
 
+func (pg *luaPG) driverName() string {
+	return `postgres`
+}
+
 func (pg *luaPG) getDB() *sql.DB {
 	pg.Lock()
 	defer pg.Unlock()
@@ -0,0 +1,395 @@
+package odbc
+
+import (
+	"context"
+	"database/sql"
+	"runtime"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// session runs the statements of a call on a db_ud or tx_ud. On a db_ud it
+// owns a transaction with the options of the database, begun with the
+// first statement.
+type session struct {
+	// nil on a tx_ud
+	db      luaDB
+	q       queryer
+	driver  string
+	types   Types
+	timeout time.Duration
+	hooks   *luaHooks
+	tx      *sql.Tx
+	// releases the connection of tx, see hold
+	release func()
+	// of the call, set by the first statement
+	ctx    context.Context
+	cancel context.CancelFunc
+	ob     *observation
+}
+
+// checkSession resolves the db_ud or tx_ud at 1.
+func checkSession(L *lua.LState) *session {
+	s := newSession(L, L.CheckUserData(1).Value)
+	if s == nil {
+		L.ArgError(1, "database or transaction expected")
+	}
+	return s
+}
+
+// newSession returns a session on a database or transaction, nil for
+// other values.
+func newSession(L *lua.LState, v any) *session {
+	switch v := v.(type) {
+	case *luaTx:
+		return &session{q: v, driver: v.driver, types: v.types, timeout: v.timeout, hooks: v.hooks}
+	case luaDB:
+		return &session{
+			db:      v,
+			driver:  v.driverName(),
+			types:   v.getTypes(),
+			timeout: v.getTimeout(),
+			hooks:   v.getHooks(),
+		}
+	}
+	return nil
+}
+
+// start starts the call with its timeout, beginning the transaction on a
+// database.
+func (s *session) start(L *lua.LState) context.Context {
+	if s.ctx != nil {
+		return s.ctx
+	}
+	s.ctx, s.cancel = callContext(L, s.timeout)
+	if s.db != nil {
+		sqlDB := s.db.getDB()
+		checkFree(L, sqlDB)
+		tx, err := sqlDB.BeginTx(s.ctx, s.db.getTXOptions())
+		if err != nil {
+			s.fail(L, err)
+		}
+		s.q, s.tx = tx, tx
+		s.release = hold(L, sqlDB, s.ctx)
+	}
+	return s.ctx
+}
+
+// end ends the call, its transaction is rolled back unless committed.
+// Defer it so that its statement is reported with the errors raised to
+// Lua.
+func (s *session) end() {
+	r := recover()
+	s.free()
+	if s.ob != nil {
+		s.ob.finish(r)
+	} else if r != nil {
+		panic(r)
+	}
+}
+
+// free rolls back the transaction unless it is committed and releases
+// its connection.
+func (s *session) free() {
+	if s.tx != nil {
+		s.tx.Rollback()
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.release != nil {
+		s.release()
+	}
+}
+
+func (s *session) commit() error {
+	if s.tx == nil {
+		return nil
+	}
+	return s.tx.Commit()
+}
+
+// fail raises err, which stopped the statement of the call.
+func (s *session) fail(L *lua.LState, err error) {
+	err = dbError(s.ctx, err)
+	if s.ob != nil {
+		s.ob.ev.Err = err
+	}
+	L.RaiseError("%v", err)
+}
+
+// scan reads the current row.
+func (s *session) scan(L *lua.LState, sqlRows *sql.Rows, m *mapper) []any {
+	values, err := scanRow(sqlRows, len(m.cols))
+	if err != nil {
+		s.fail(L, err)
+	}
+	s.ob.ev.Rows++
+	return values
+}
+
+// open runs the query at 2 with the bind arguments after it.
+func (s *session) open(L *lua.LState) (*sql.Rows, *mapper) {
+	query, types := checkQuery(L, 2, s.types)
+	s.timeout = checkTimeout(L, 2, s.timeout)
+	query, args := bindArgs(L, s.driver, query, 3)
+	return s.query(L, query, args, types)
+}
+
+// query runs a query returning rows, which are counted as they are
+// scanned.
+func (s *session) query(L *lua.LState, query string, args []any, types Types) (*sql.Rows, *mapper) {
+	s.ob = observe(L, s.hooks, "query", query, len(args))
+	s.ob.ev.Rows = 0
+	ctx := s.start(L)
+	sqlRows, err := s.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		s.fail(L, err)
+	}
+	m, err := newMapper(L, sqlRows, types)
+	if err != nil {
+		sqlRows.Close()
+		s.fail(L, err)
+	}
+	return sqlRows, m
+}
+
+// Rows lua db_ud:rows(query, ...) returns {{column=value}, ...}
+func Rows(L *lua.LState) int {
+	s := checkSession(L)
+	defer s.end()
+	sqlRows, m := s.open(L)
+	L.Push(s.collect(L, sqlRows, m))
+	return 1
+}
+
+// collect reads all rows keyed by column name and commits.
+func (s *session) collect(L *lua.LState, sqlRows *sql.Rows, m *mapper) *lua.LTable {
+	defer sqlRows.Close()
+	rows := L.NewTable()
+	for sqlRows.Next() {
+		rows.Append(m.row(s.scan(L, sqlRows, m)))
+	}
+	if err := sqlRows.Err(); err != nil {
+		s.fail(L, err)
+	}
+	sqlRows.Close()
+	if err := s.commit(); err != nil {
+		s.fail(L, err)
+	}
+	return rows
+}
+
+// exec runs a statement and commits.
+func (s *session) exec(L *lua.LState, query string, args []any) *lua.LTable {
+	s.ob = observe(L, s.hooks, "exec", query, len(args))
+	ctx := s.start(L)
+	result := runExec(L, s.ob, ctx, s.q, query, args)
+	if err := s.commit(); err != nil {
+		s.fail(L, err)
+	}
+	return result
+}
+
+// first returns the values of the first row, nil if there is none.
+func first(L *lua.LState) (*mapper, []any) {
+	s := checkSession(L)
+	defer s.end()
+	sqlRows, m := s.open(L)
+	defer sqlRows.Close()
+	var values []any
+	if sqlRows.Next() {
+		values = s.scan(L, sqlRows, m)
+	}
+	if err := sqlRows.Err(); err != nil {
+		s.fail(L, err)
+	}
+	sqlRows.Close()
+	if err := s.commit(); err != nil {
+		s.fail(L, err)
+	}
+	return m, values
+}
+
+// One lua db_ud:one(query, ...) returns {column=value} or nil
+func One(L *lua.LState) int {
+	m, values := first(L)
+	if values == nil {
+		L.Push(lua.LNil)
+	} else {
+		L.Push(m.row(values))
+	}
+	return 1
+}
+
+// Scalar lua db_ud:scalar(query, ...) returns the first value of the first
+// row or nil
+func Scalar(L *lua.LState) int {
+	m, values := first(L)
+	if len(values) == 0 {
+		L.Push(lua.LNil)
+	} else {
+		L.Push(m.value(0, values[0]))
+	}
+	return 1
+}
+
+// Each lua db_ud:each(query, ..., fn) returns the number of rows seen
+// Calls fn(row) for every row as it is read, stopping early if fn returns
+// false.
+func Each(L *lua.LState) int {
+	fn := L.CheckFunction(L.GetTop())
+	L.Pop(1)
+	s := checkSession(L)
+	defer s.end()
+	sqlRows, m := s.open(L)
+	defer sqlRows.Close()
+	n := 0
+	for sqlRows.Next() {
+		values := s.scan(L, sqlRows, m)
+		n++
+		L.Push(fn)
+		L.Push(m.row(values))
+		L.Call(1, 1)
+		ret := L.Get(-1)
+		L.Pop(1)
+		if ret == lua.LFalse {
+			break
+		}
+	}
+	if err := sqlRows.Err(); err != nil {
+		s.fail(L, err)
+	}
+	sqlRows.Close()
+	if err := s.commit(); err != nil {
+		s.fail(L, err)
+	}
+	L.Push(lua.LNumber(n))
+	return 1
+}
+
+type luaCursor struct {
+	s    *session
+	rows *sql.Rows
+	m    *mapper
+	done bool
+}
+
+// Cursor lua db_ud:cursor(query, ...) returns cursor_ud
+// The cursor holds a connection until it is read to the end or closed,
+// the timeout of the call covers reading it. A cursor that is not closed
+// is released with the request it was opened in, or once it is garbage
+// collected. Other calls on the database while the cursor holds its only
+// connection raise an error.
+func Cursor(L *lua.LState) int {
+	s := checkSession(L)
+	sqlRows, m := func() (*sql.Rows, *mapper) {
+		ok := false
+		defer func() {
+			if !ok {
+				s.end()
+			}
+		}()
+		sqlRows, m := s.open(L)
+		ok = true
+		return sqlRows, m
+	}()
+	c := &luaCursor{s: s, rows: sqlRows, m: m}
+	runtime.SetFinalizer(c, (*luaCursor).finalize)
+	ud := L.NewUserData()
+	ud.Value = c
+	L.SetMetatable(ud, L.GetTypeMetatable(`cursor_ud`))
+	L.Push(ud)
+	return 1
+}
+
+func checkCursor(L *lua.LState, n int) *luaCursor {
+	ud := L.CheckUserData(n)
+	if v, ok := ud.Value.(*luaCursor); ok {
+		return v
+	}
+	L.ArgError(n, "cursor_ud expected")
+	return nil
+}
+
+// next returns the next row, nil after the last one.
+func (c *luaCursor) next(L *lua.LState) lua.LValue {
+	if c.done {
+		return lua.LNil
+	}
+	if !c.rows.Next() {
+		if err := c.rows.Err(); err != nil {
+			c.fail(L, err)
+		}
+		if err := c.close(true); err != nil {
+			L.RaiseError("%v", err)
+		}
+		return lua.LNil
+	}
+	values, err := scanRow(c.rows, len(c.m.cols))
+	if err != nil {
+		c.fail(L, err)
+	}
+	c.s.ob.ev.Rows++
+	return c.m.row(values)
+}
+
+// fail raises err and closes the cursor, once the error is told from a
+// timeout.
+func (c *luaCursor) fail(L *lua.LState, err error) {
+	defer c.close(false)
+	c.s.fail(L, err)
+}
+
+// close ends the cursor, committing its transaction if it was read to the
+// end.
+func (c *luaCursor) close(commit bool) error {
+	if c.done {
+		return nil
+	}
+	c.done = true
+	c.rows.Close()
+	defer c.s.end()
+	if commit {
+		return c.s.commit()
+	}
+	return nil
+}
+
+// finalize releases a cursor dropped without being closed. It runs on the
+// finalizer goroutine and must not call Lua, so the statement is not
+// reported to hooks.
+func (c *luaCursor) finalize() {
+	if c.done {
+		return
+	}
+	c.done = true
+	c.rows.Close()
+	c.s.free()
+}
+
+// CursorNext lua cursor_ud:next() returns {column=value} or nil
+func CursorNext(L *lua.LState) int {
+	L.Push(checkCursor(L, 1).next(L))
+	return 1
+}
+
+// CursorRows lua cursor_ud:rows() returns an iterator over the remaining
+// rows: for row in cursor:rows() do ... end
+func CursorRows(L *lua.LState) int {
+	c := checkCursor(L, 1)
+	L.Push(L.NewFunction(func(L *lua.LState) int {
+		L.Push(c.next(L))
+		return 1
+	}))
+	return 1
+}
+
+// CursorClose lua cursor_ud:close()
+func CursorClose(L *lua.LState) int {
+	if err := checkCursor(L, 1).close(false); err != nil {
+		L.RaiseError("%v", err)
+	}
+	return 0
+}
@@ -3,6 +3,7 @@ package odbc
 import (
 	"database/sql"
 	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -27,9 +28,11 @@ func (sqlite *luaSQLite) constructor(config *dbConfig) (luaDB, error) {
 	defer sharedSqliteLock.Unlock()
 
 	if config.sharedMode {
-		result, ok := sharedSqlite[config.connString]
-		if ok {
-			return result, nil
+		if shared, ok := sharedSqlite[config.connString]; ok {
+			if err := samePool(shared.config, config); err != nil {
+				return nil, err
+			}
+			return &luaSQLite{config: config, db: shared.db}, nil
 		}
 	}
 
@@ -37,8 +40,9 @@ func (sqlite *luaSQLite) constructor(config *dbConfig) (luaDB, error) {
 	if err != nil {
 		return nil, err
 	}
-	db.SetMaxIdleConns(config.maxOpenConns)
-	db.SetMaxOpenConns(config.maxOpenConns)
+	if err := setupDB(db, config); err != nil {
+		return nil, err
+	}
 	result := &luaSQLite{config: config}
 	result.db = db
 
@@ -49,12 +53,28 @@ func (sqlite *luaSQLite) constructor(config *dbConfig) (luaDB, error) {
 	return result, nil
 }
 
+func (sqlite *luaSQLite) driverName() string {
+	return `sqlite3`
+}
+
 func (sqlite *luaSQLite) getDB() *sql.DB {
 	sqlite.Lock()
 	defer sqlite.Unlock()
 	return sqlite.db
 }
 
+func (sqlite *luaSQLite) getTypes() Types {
+	return sqlite.config.types
+}
+
+func (sqlite *luaSQLite) getTimeout() time.Duration {
+	return seconds(sqlite.config.pool.Timeout)
+}
+
+func (sqlite *luaSQLite) getHooks() *luaHooks {
+	return sqlite.config.hooks
+}
+
 func (sqlite *luaSQLite) getTXOptions() *sql.TxOptions {
 	return &sql.TxOptions{ReadOnly: sqlite.config.readOnly}
 }
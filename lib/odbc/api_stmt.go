@@ -2,41 +2,58 @@ package odbc
 
 import (
 	"database/sql"
+	"time"
 
 	lua "github.com/yuin/gopher-lua"
 )
 
 type luaStmt struct {
 	*sql.Stmt
-	d *sql.DB
+	query string
+	types Types
+	// of every call
+	timeout time.Duration
+	hooks   *luaHooks
+	// prepared on, nil on a transaction
+	db *sql.DB
 }
 
 // Stmt lua db_ud:stmt(query) returns stmt_ud
 func Stmt(L *lua.LState) int {
 	dbInterface := checkDB(L, 1)
-	query := L.CheckString(2)
-	sqlDB := dbInterface.getDB()
-	s, err := sqlDB.Prepare(query)
+	query, types := checkQuery(L, 2, dbInterface.getTypes())
+	timeout := checkTimeout(L, 2, dbInterface.getTimeout())
+	query = rebind(L, dbInterface.driverName(), query)
+	L.Push(newStmt(L, dbInterface.getDB(), dbInterface.getHooks(), query, types, timeout))
+	return 1
+}
+
+// newStmt prepares query on q, whose statements are reported to hooks.
+func newStmt(L *lua.LState, q queryer, hooks *luaHooks, query string, types Types, timeout time.Duration) *lua.LUserData {
+	if db, ok := q.(*sql.DB); ok {
+		checkFree(L, db)
+	}
+	ctx, cancel := callContext(L, timeout)
+	defer cancel()
+	s, err := q.PrepareContext(ctx, query)
 	if err != nil {
-		L.RaiseError("%v", err)
+		raise(L, ctx, err)
 	}
 	ud := L.NewUserData()
-	ud.Value = &luaStmt{Stmt: s, d: sqlDB}
+	db, _ := q.(*sql.DB)
+	ud.Value = &luaStmt{Stmt: s, query: query, types: types, timeout: timeout, hooks: hooks, db: db}
 	L.SetMetatable(ud, L.GetTypeMetatable(`stmt_ud`))
-	L.Push(ud)
-	return 1
+	return ud
 }
 
 func getSTMTArgs(L *lua.LState) []interface{} {
 	args := make([]interface{}, 0)
 	for i := 2; i <= L.GetTop(); i++ {
-		any := L.CheckAny(i)
-		switch any.Type() {
-		case lua.LTNil:
-			args = append(args, nil)
-		default:
-			args = append(args, L.CheckAny(i))
+		arg, err := toArg(L.Get(i))
+		if err != nil {
+			L.ArgError(i, err.Error())
 		}
+		args = append(args, arg)
 	}
 	return args
 }
@@ -49,18 +66,19 @@ func StmtQuery(L *lua.LState) int {
 		L.ArgError(1, "must be stmt_ud")
 	}
 	args := getSTMTArgs(L)
-	sqlRows, err := s.Query(args...)
-	if err != nil {
-		L.RaiseError("%v", err)
+	ob := observe(L, s.hooks, "stmt_query", s.query, len(args))
+	defer ob.done()
+	ctx, cancel := callContext(L, s.timeout)
+	defer cancel()
+	if s.db != nil {
+		checkFree(L, s.db)
 	}
-	defer sqlRows.Close()
-	rows, columns, err := parseRows(sqlRows, L)
+	sqlRows, err := s.QueryContext(ctx, args...)
 	if err != nil {
-		L.RaiseError("%v", err)
+		raise(L, ctx, err)
 	}
-	result := L.NewTable()
-	result.RawSetString(`rows`, rows)
-	result.RawSetString(`columns`, columns)
+	result := rowsResult(L, ctx, sqlRows, s.types)
+	ob.result(result)
 	L.Push(result)
 	return 1
 }
@@ -73,17 +91,19 @@ func StmtExec(L *lua.LState) int {
 		L.ArgError(1, "must be stmt_ud")
 	}
 	args := getSTMTArgs(L)
-	sqlResult, err := s.Exec(args...)
-	if err != nil {
-		L.RaiseError("%v", err)
-	}
-	result := L.NewTable()
-	if id, err := sqlResult.LastInsertId(); err == nil {
-		result.RawSetString(`last_insert_id`, lua.LNumber(id))
+	ob := observe(L, s.hooks, "stmt_exec", s.query, len(args))
+	defer ob.done()
+	ctx, cancel := callContext(L, s.timeout)
+	defer cancel()
+	if s.db != nil {
+		checkFree(L, s.db)
 	}
-	if aff, err := sqlResult.RowsAffected(); err == nil {
-		result.RawSetString(`rows_affected`, lua.LNumber(aff))
+	sqlResult, err := s.ExecContext(ctx, args...)
+	if err != nil {
+		raise(L, ctx, err)
 	}
+	result := execResult(L, sqlResult)
+	ob.result(result)
 	L.Push(result)
 	return 1
 }
@@ -0,0 +1,252 @@
+package odbc
+
+import (
+	"database/sql"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type luaTx struct {
+	*sql.Tx
+	driver string
+	types  Types
+	// of every statement
+	timeout time.Duration
+	// of the database, nil if begun in Go
+	hooks *luaHooks
+	// savepoints currently open
+	depth int
+	// releases the connection, see hold; nil if begun in Go
+	release func()
+}
+
+// Commit commits the transaction and releases its connection.
+func (tx *luaTx) Commit() error {
+	if tx.release != nil {
+		defer tx.release()
+	}
+	return tx.Tx.Commit()
+}
+
+// Rollback rolls back the transaction and releases its connection.
+func (tx *luaTx) Rollback() error {
+	if tx.release != nil {
+		defer tx.release()
+	}
+	return tx.Tx.Rollback()
+}
+
+// Isolation levels by name, spaces and dashes may replace underscores.
+var isolationLevels = map[string]sql.IsolationLevel{
+	"default":          sql.LevelDefault,
+	"read_uncommitted": sql.LevelReadUncommitted,
+	"read_committed":   sql.LevelReadCommitted,
+	"write_committed":  sql.LevelWriteCommitted,
+	"repeatable_read":  sql.LevelRepeatableRead,
+	"snapshot":         sql.LevelSnapshot,
+	"serializable":     sql.LevelSerializable,
+	"linearizable":     sql.LevelLinearizable,
+}
+
+func checkTx(L *lua.LState, n int) *luaTx {
+	ud := L.CheckUserData(n)
+	if v, ok := ud.Value.(*luaTx); ok {
+		return v
+	}
+	L.ArgError(n, "tx_ud expected")
+	return nil
+}
+
+// txOptions reads the options table at n:
+//
+//	{
+//	  isolation="read committed",
+//	  read_only=false
+//	}
+func txOptions(L *lua.LState, dbInterface luaDB, n int) *sql.TxOptions {
+	opts := *dbInterface.getTXOptions()
+	t, ok := L.Get(n).(*lua.LTable)
+	if !ok {
+		if L.Get(n) != lua.LNil {
+			L.ArgError(n, "options table expected")
+		}
+		return &opts
+	}
+	if v := t.RawGetString("isolation"); v != lua.LNil {
+		name := strings.NewReplacer(" ", "_", "-", "_").Replace(strings.ToLower(v.String()))
+		level, ok := isolationLevels[name]
+		if !ok {
+			L.ArgError(n, fmt.Sprintf("unknown isolation level %q", v.String()))
+		}
+		opts.Isolation = level
+	}
+	if lua.LVAsBool(t.RawGetString("read_only")) {
+		opts.ReadOnly = true
+	}
+	return &opts
+}
+
+// begin begins a transaction that is rolled back if the context of L is
+// canceled before it ends, e.g. when the request it serves is done.
+// A transaction that is dropped without ending is rolled back once it is
+// garbage collected.
+func begin(L *lua.LState, dbInterface luaDB, opts *sql.TxOptions) *lua.LUserData {
+	ctx := stateContext(L)
+	sqlDB := dbInterface.getDB()
+	checkFree(L, sqlDB)
+	tx, err := sqlDB.BeginTx(ctx, opts)
+	if err != nil {
+		raise(L, ctx, err)
+	}
+	ltx := &luaTx{
+		Tx:      tx,
+		driver:  dbInterface.driverName(),
+		types:   dbInterface.getTypes(),
+		timeout: dbInterface.getTimeout(),
+		hooks:   dbInterface.getHooks(),
+		release: hold(L, sqlDB, ctx),
+	}
+	runtime.SetFinalizer(ltx, func(tx *luaTx) { tx.Rollback() })
+	ud := L.NewUserData()
+	ud.Value = ltx
+	L.SetMetatable(ud, L.GetTypeMetatable(`tx_ud`))
+	return ud
+}
+
+// NewTx returns a tx_ud of a transaction begun in Go, e.g. to run Lua in
+// it. The caller commits or rolls back tx.
+func NewTx(L *lua.LState, tx *sql.Tx, driver string) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = &luaTx{Tx: tx, driver: driver}
+	L.SetMetatable(ud, L.GetTypeMetatable(`tx_ud`))
+	return ud
+}
+
+// Begin lua db_ud:begin(options) returns tx_ud
+// The transaction holds a connection until it is committed or rolled back.
+// Other calls on the database while it holds the only connection raise an
+// error, run them on the transaction instead.
+func Begin(L *lua.LState) int {
+	dbInterface := checkDB(L, 1)
+	L.Push(begin(L, dbInterface, txOptions(L, dbInterface, 2)))
+	return 1
+}
+
+// Transaction lua db_ud:transaction(fn, options) returns the results of fn
+// fn is called with a tx_ud. The transaction is committed if fn returns
+// and rolled back if it raises an error, which is raised again.
+func Transaction(L *lua.LState) int {
+	dbInterface := checkDB(L, 1)
+	fn := L.CheckFunction(2)
+	ud := begin(L, dbInterface, txOptions(L, dbInterface, 3))
+	tx := ud.Value.(*luaTx)
+	return callTx(L, ud, fn, tx.Commit, tx.Rollback)
+}
+
+// callTx calls fn(ud) and then commit, or rollback if fn raised an error.
+func callTx(L *lua.LState, ud *lua.LUserData, fn *lua.LFunction, commit, rollback func() error) int {
+	top := L.GetTop()
+	L.Push(fn)
+	L.Push(ud)
+	if err := L.PCall(1, lua.MultRet, nil); err != nil {
+		if rerr := rollback(); rerr != nil {
+			L.RaiseError("%v (rollback: %v)", err, rerr)
+		}
+		if lerr, ok := err.(*lua.ApiError); ok {
+			L.Error(lerr.Object, 0)
+		}
+		L.RaiseError("%v", err)
+	}
+	if err := commit(); err != nil {
+		L.RaiseError("commit: %v", err)
+	}
+	return L.GetTop() - top
+}
+
+// TxQuery lua tx_ud:query(query, ...) returns {rows = {}, columns = {}}
+func TxQuery(L *lua.LState) int {
+	tx := checkTx(L, 1)
+	query, types := checkQuery(L, 2, tx.types)
+	timeout := checkTimeout(L, 2, tx.timeout)
+	query, args := bindArgs(L, tx.driver, query, 3)
+	ob := observe(L, tx.hooks, "query", query, len(args))
+	defer ob.done()
+	ctx, cancel := callContext(L, timeout)
+	defer cancel()
+	L.Push(runQuery(L, ob, ctx, tx, query, args, types))
+	return 1
+}
+
+// TxExec lua tx_ud:exec(query, ...) returns {rows_affected=number, last_insert_id=number}
+func TxExec(L *lua.LState) int {
+	tx := checkTx(L, 1)
+	query, _ := checkQuery(L, 2, tx.types)
+	timeout := checkTimeout(L, 2, tx.timeout)
+	query, args := bindArgs(L, tx.driver, query, 3)
+	ob := observe(L, tx.hooks, "exec", query, len(args))
+	defer ob.done()
+	ctx, cancel := callContext(L, timeout)
+	defer cancel()
+	L.Push(runExec(L, ob, ctx, tx, query, args))
+	return 1
+}
+
+// TxStmt lua tx_ud:stmt(query) returns stmt_ud, valid until the transaction
+// ends
+func TxStmt(L *lua.LState) int {
+	tx := checkTx(L, 1)
+	query, types := checkQuery(L, 2, tx.types)
+	timeout := checkTimeout(L, 2, tx.timeout)
+	L.Push(newStmt(L, tx, tx.hooks, rebind(L, tx.driver, query), types, timeout))
+	return 1
+}
+
+// TxCommit lua tx_ud:commit()
+func TxCommit(L *lua.LState) int {
+	tx := checkTx(L, 1)
+	if err := tx.Commit(); err != nil {
+		L.RaiseError("%v", err)
+	}
+	return 0
+}
+
+// TxRollback lua tx_ud:rollback()
+func TxRollback(L *lua.LState) int {
+	tx := checkTx(L, 1)
+	if err := tx.Rollback(); err != nil {
+		L.RaiseError("%v", err)
+	}
+	return 0
+}
+
+// TxTransaction lua tx_ud:transaction(fn) returns the results of fn
+// Runs fn(tx) in a savepoint that is released if fn returns and rolled back
+// to if it raises an error, leaving the outer transaction usable.
+func TxTransaction(L *lua.LState) int {
+	tx := checkTx(L, 1)
+	fn := L.CheckFunction(2)
+	tx.depth++
+	defer func() { tx.depth-- }()
+	name := fmt.Sprintf("sp_%d", tx.depth)
+	savepoint := func(stmt string) func() error {
+		return func() error {
+			ob := observe(L, tx.hooks, "exec", stmt, 0)
+			defer ob.done()
+			ctx, cancel := callContext(L, tx.timeout)
+			defer cancel()
+			_, err := tx.ExecContext(ctx, stmt)
+			ob.ev.Err = err
+			return err
+		}
+	}
+	if err := savepoint("SAVEPOINT " + name)(); err != nil {
+		L.RaiseError("%v", err)
+	}
+	return callTx(L, L.CheckUserData(1), fn,
+		savepoint("RELEASE SAVEPOINT "+name),
+		savepoint("ROLLBACK TO SAVEPOINT "+name))
+}
@@ -0,0 +1,324 @@
+package odbc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// placeholder returns the n-th placeholder, counting from 1, of driver.
+func placeholder(driver string, n int) string {
+	if driver == "postgres" {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// bindArgs reads the bind arguments of a statement from index n on and
+// rewrites query for the driver. A single table with string keys binds
+// :name and @name parameters, an array table or plain values bind ?
+// placeholders in order.
+func bindArgs(L *lua.LState, driver, query string, n int) (string, []any) {
+	var values []lua.LValue
+	for i := n; i <= L.GetTop(); i++ {
+		values = append(values, L.Get(i))
+	}
+	if len(values) == 1 {
+		if t, ok := values[0].(*lua.LTable); ok {
+			if isArray(t) {
+				values = values[:0]
+				t.ForEach(func(_, v lua.LValue) {
+					values = append(values, v)
+				})
+			} else {
+				query, args, err := bindNamed(driver, query, t)
+				if err != nil {
+					L.RaiseError("%v", err)
+				}
+				return query, args
+			}
+		}
+	}
+	args := make([]any, len(values))
+	for i, v := range values {
+		arg, err := toArg(v)
+		if err != nil {
+			L.RaiseError("bind argument #%d: %v", i+1, err)
+		}
+		args[i] = arg
+	}
+	if len(args) > 0 {
+		query = rebind(L, driver, query)
+	}
+	return query, args
+}
+
+// isArray reports whether t has no keys besides 1..n.
+func isArray(t *lua.LTable) bool {
+	n := t.Len()
+	array := true
+	t.ForEach(func(k, _ lua.LValue) {
+		i, ok := k.(lua.LNumber)
+		if !ok || float64(i) != math.Trunc(float64(i)) || int(i) < 1 || int(i) > n {
+			array = false
+		}
+	})
+	return array
+}
+
+// toArg converts a Lua value to a bind argument. Integral numbers are bound
+// as integers.
+func toArg(v lua.LValue) (any, error) {
+	switch v := v.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		f := float64(v)
+		if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return int64(f), nil
+		}
+		return f, nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LUserData:
+		return v.Value, nil
+	}
+	return nil, fmt.Errorf("cannot bind %s", v.Type())
+}
+
+// Rebind rewrites the ? placeholders of query for driver, see
+// rewritePositional.
+func Rebind(driver, query string) (string, error) {
+	return rewritePositional(driver, query)
+}
+
+// rebind is Rebind raising its error to Lua.
+func rebind(L *lua.LState, driver, query string) string {
+	query, err := rewritePositional(driver, query)
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	return query
+}
+
+var errMixedPlaceholders = errors.New("query mixes $n and ? placeholders")
+
+// rewritePositional turns the ? placeholders of query into $n for
+// postgres, where ?? stands for the jsonb ? operator and the ?| and ?&
+// operators are kept. Queries already using $n keep them, but may not use
+// ? as well.
+func rewritePositional(driver, query string) (string, error) {
+	if driver != "postgres" {
+		return query, nil
+	}
+	var (
+		n                    int
+		numbered, positional bool
+		b                    strings.Builder
+	)
+	scanSQLInto(&b, driver, query, func(tok string) string {
+		switch {
+		case tok == "?":
+			positional = true
+			n++
+			return placeholder(driver, n)
+		case tok == "??":
+			return "?"
+		case tok[0] == '$':
+			numbered = true
+		}
+		return tok
+	})
+	if numbered && positional {
+		return "", errMixedPlaceholders
+	}
+	return b.String(), nil
+}
+
+// bindNamed replaces the :name and @name parameters of query with the
+// placeholders of driver and returns their values from t.
+func bindNamed(driver, query string, t *lua.LTable) (string, []any, error) {
+	var (
+		args []any
+		// postgres placeholders of names already bound
+		index = make(map[string]int)
+		err   error
+		b     strings.Builder
+	)
+	scanSQLInto(&b, driver, query, func(tok string) string {
+		if err != nil || len(tok) < 2 || (tok[0] != ':' && tok[0] != '@') {
+			return tok
+		}
+		name := tok[1:]
+		if i, ok := index[name]; ok && driver == "postgres" {
+			return placeholder(driver, i)
+		}
+		v := t.RawGetString(name)
+		if v == lua.LNil {
+			err = fmt.Errorf("missing named parameter %s", tok)
+			return tok
+		}
+		arg, cerr := toArg(v)
+		if cerr != nil {
+			err = fmt.Errorf("bind %s: %v", tok, cerr)
+			return tok
+		}
+		args = append(args, arg)
+		index[name] = len(args)
+		return placeholder(driver, len(args))
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return b.String(), args, nil
+}
+
+// hasNumbered reports whether query has a $n placeholder outside of
+// literals and comments.
+func hasNumbered(driver, query string) bool {
+	found := false
+	var b strings.Builder
+	scanSQLInto(&b, driver, query, func(tok string) string {
+		if tok[0] == '$' {
+			found = true
+		}
+		return tok
+	})
+	return found
+}
+
+// scanSQLInto copies query to b, passing every placeholder token outside of
+// literals and comments through fn: ?, $n, :name and @name, and ?? in
+// postgres. Postgres casts (::), array slices ([1:2]) and the ?| and ?&
+// operators are not parameters. Backticks quote, backslashes escape and #
+// starts a comment only in mysql; postgres also has E'...' strings with
+// backslash escapes and $tag$ quoted strings.
+func scanSQLInto(b *strings.Builder, driver, query string, fn func(tok string) string) {
+	pg := driver == "postgres"
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`' && driver == "mysql":
+			escapes := driver == "mysql" || pg && c == '\'' && isEString(query, i)
+			j := i + 1
+			for j < len(query) {
+				if query[j] == c {
+					if j+1 < len(query) && query[j+1] == c {
+						// doubled quote
+						j += 2
+						continue
+					}
+					break
+				}
+				if query[j] == '\\' && escapes {
+					j++
+				}
+				j++
+			}
+			j = min(j+1, len(query))
+			b.WriteString(query[i:j])
+			i = j
+		case c == '-' && strings.HasPrefix(query[i:], "--"), c == '#' && driver == "mysql":
+			j := strings.IndexByte(query[i:], '\n')
+			if j < 0 {
+				j = len(query) - i
+			}
+			b.WriteString(query[i : i+j])
+			i += j
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			j := strings.Index(query[i+2:], "*/")
+			if j < 0 {
+				j = len(query) - i
+			} else {
+				j += 4
+			}
+			b.WriteString(query[i : i+j])
+			i += j
+		case c == '$' && pg && dollarTag(query[i:]) != "":
+			tag := dollarTag(query[i:])
+			j := strings.Index(query[i+len(tag):], tag)
+			if j < 0 {
+				j = len(query) - i
+			} else {
+				j += 2 * len(tag)
+			}
+			b.WriteString(query[i : i+j])
+			i += j
+		case c == ':' && strings.HasPrefix(query[i:], "::"):
+			b.WriteString("::")
+			i += 2
+		case c == '?' && pg && strings.HasPrefix(query[i:], "??"):
+			b.WriteString(fn("??"))
+			i += 2
+		case c == '?' && pg && isJSONBOperator(query[i:]):
+			b.WriteString(query[i : i+2])
+			i += 2
+		case c == '?':
+			b.WriteString(fn("?"))
+			i++
+		case c == '$' || c == ':' || c == '@':
+			j := i + 1
+			for j < len(query) && isIdent(query[j], c == '$') {
+				j++
+			}
+			if j == i+1 || (c != '$' && isDigit(query[i+1])) {
+				b.WriteByte(c)
+				i++
+				continue
+			}
+			b.WriteString(fn(query[i:j]))
+			i = j
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+}
+
+// isEString reports whether the quote at i starts a postgres E'...' string.
+func isEString(query string, i int) bool {
+	if i == 0 || query[i-1] != 'E' && query[i-1] != 'e' {
+		return false
+	}
+	return i == 1 || !isIdent(query[i-2], false)
+}
+
+// dollarTag returns the $tag$ or $$ starting s, if any.
+func dollarTag(s string) string {
+	for j := 1; j < len(s); j++ {
+		switch {
+		case s[j] == '$':
+			return s[:j+1]
+		case !isIdent(s[j], false) || j == 1 && isDigit(s[j]):
+			return ""
+		}
+	}
+	return ""
+}
+
+// isJSONBOperator reports whether s starts with the ?| or ?& operator of
+// postgres, rather than a placeholder followed by || or &&.
+func isJSONBOperator(s string) bool {
+	if len(s) < 2 || s[1] != '|' && s[1] != '&' {
+		return false
+	}
+	return len(s) == 2 || s[2] != s[1]
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// isIdent reports whether c continues a parameter name, only digits for $n.
+func isIdent(c byte, digits bool) bool {
+	if digits {
+		return isDigit(c)
+	}
+	return c == '_' || isDigit(c) || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
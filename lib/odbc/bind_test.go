@@ -0,0 +1,92 @@
+package odbc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestRewritePositional(t *testing.T) {
+	tests := []struct {
+		name, driver, query, want string
+		err                       error
+	}{
+		{"plain", "postgres", "SELECT * FROM t WHERE a = ? AND b = ?", "SELECT * FROM t WHERE a = $1 AND b = $2", nil},
+		{"other drivers", "mysql", "SELECT ? FROM t WHERE a = ?", "SELECT ? FROM t WHERE a = ?", nil},
+		{"sqlite", "sqlite3", "SELECT ?", "SELECT ?", nil},
+		{"single quotes", "postgres", "SELECT '?', 'it''s ?', ?", "SELECT '?', 'it''s ?', $1", nil},
+		{"double quotes", "postgres", `SELECT "a?" FROM t WHERE x = ?`, `SELECT "a?" FROM t WHERE x = $1`, nil},
+		{"line comment", "postgres", "SELECT ? -- why?\nFROM t WHERE a = ?", "SELECT $1 -- why?\nFROM t WHERE a = $2", nil},
+		{"block comment", "postgres", "SELECT /* ? */ ?", "SELECT /* ? */ $1", nil},
+		{"unterminated comment", "postgres", "SELECT ? /* ?", "SELECT $1 /* ?", nil},
+		{"cast", "postgres", "SELECT ?::int, a::text", "SELECT $1::int, a::text", nil},
+		{"array slice", "postgres", "SELECT a[1:2], a[?:3] FROM t", "SELECT a[1:2], a[$1:3] FROM t", nil},
+		{"jsonb exists", "postgres", "SELECT * FROM t WHERE data ?? 'k' AND id = ?", "SELECT * FROM t WHERE data ? 'k' AND id = $1", nil},
+		{"jsonb any all", "postgres", "SELECT * FROM t WHERE data ?| ? AND data ?& ?", "SELECT * FROM t WHERE data ?| $1 AND data ?& $2", nil},
+		{"concat", "postgres", "SELECT ?||'x', ?&&a", "SELECT $1||'x', $2&&a", nil},
+		{"e string", "postgres", `SELECT E'\'?', '\', ?`, `SELECT E'\'?', '\', $1`, nil},
+		{"dollar quotes", "postgres", "SELECT $$ ? $$, $fn$ ?$ $fn$, ?", "SELECT $$ ? $$, $fn$ ?$ $fn$, $1", nil},
+		{"numbered", "postgres", "SELECT $1, $2, $1", "SELECT $1, $2, $1", nil},
+		{"numbered jsonb", "postgres", "SELECT data ?? $1", "SELECT data ? $1", nil},
+		{"mixed", "postgres", "SELECT $1 WHERE a = ?", "", errMixedPlaceholders},
+		{"mixed in literals", "postgres", "SELECT '$1', ?", "SELECT '$1', $1", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rewritePositional(tt.driver, tt.query)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBindNamed(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	params := L.NewTable()
+	params.RawSetString("id", lua.LNumber(7))
+	params.RawSetString("name", lua.LString("bob"))
+
+	tests := []struct {
+		name, driver, query, want string
+		args                      []any
+		err                       string
+	}{
+		{"postgres", "postgres", "SELECT * FROM t WHERE id = :id AND name = @name", "SELECT * FROM t WHERE id = $1 AND name = $2", []any{int64(7), "bob"}, ""},
+		{"mysql", "mysql", "SELECT * FROM t WHERE id = :id AND name = @name", "SELECT * FROM t WHERE id = ? AND name = ?", []any{int64(7), "bob"}, ""},
+		{"repeated postgres", "postgres", "SELECT :id, :name, :id", "SELECT $1, $2, $1", []any{int64(7), "bob"}, ""},
+		{"repeated sqlite", "sqlite3", "SELECT :id, :name, :id", "SELECT ?, ?, ?", []any{int64(7), "bob", int64(7)}, ""},
+		{"quotes", "postgres", `SELECT ':id', ":id", :id`, `SELECT ':id', ":id", $1`, []any{int64(7)}, ""},
+		{"comments", "sqlite3", "SELECT :id -- :name\n/* @name */", "SELECT ? -- :name\n/* @name */", []any{int64(7)}, ""},
+		{"cast", "postgres", "SELECT :id::int", "SELECT $1::int", []any{int64(7)}, ""},
+		{"array slice", "postgres", "SELECT a[1:2] FROM t WHERE id = :id", "SELECT a[1:2] FROM t WHERE id = $1", []any{int64(7)}, ""},
+		{"mysql backslash", "mysql", `SELECT 'it\'s :name', :id`, `SELECT 'it\'s :name', ?`, []any{int64(7)}, ""},
+		{"mysql backticks", "mysql", "SELECT `:name` FROM t WHERE id = :id", "SELECT `:name` FROM t WHERE id = ?", []any{int64(7)}, ""},
+		{"mysql hash comment", "mysql", "SELECT :id # :name", "SELECT ? # :name", []any{int64(7)}, ""},
+		{"backslash not mysql", "sqlite3", `SELECT '\', :id`, `SELECT '\', ?`, []any{int64(7)}, ""},
+		{"missing", "postgres", "SELECT :nope", "", nil, "missing named parameter :nope"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, args, err := bindNamed(tt.driver, tt.query, params)
+			if err != nil || tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args %v, want %v", args, tt.args)
+			}
+		})
+	}
+}
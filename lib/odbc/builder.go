@@ -0,0 +1,537 @@
+package odbc
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaBuilder builds a statement on a table. Every method returns a copy,
+// so a builder can be kept and extended.
+type luaBuilder struct {
+	// luaDB or *luaTx
+	src       any
+	driver    string
+	types     Types
+	timeout   time.Duration
+	table     string
+	where     []string
+	args      []any
+	order     []string
+	limit     int
+	offset    int
+	returning []string
+}
+
+// identifiers, optionally qualified, quoted by the builder
+var (
+	identPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*|\.\*)?$`)
+	orderPattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)?)(\s+(?i:asc|desc))?$`)
+)
+
+// Table lua db_ud:table(name) returns builder_ud
+//
+//	db:table("users"):where({active=true}):order("id desc"):limit(10):select()
+func Table(L *lua.LState) int {
+	b := &luaBuilder{table: L.CheckString(2), limit: -1, offset: -1}
+	switch v := L.CheckUserData(1).Value.(type) {
+	case *luaTx:
+		b.src, b.driver, b.types, b.timeout = v, v.driver, v.types, v.timeout
+	case luaDB:
+		b.src, b.driver, b.types, b.timeout = v, v.driverName(), v.getTypes(), v.getTimeout()
+	default:
+		L.ArgError(1, "database or transaction expected")
+	}
+	if !identPattern.MatchString(b.table) {
+		L.ArgError(2, fmt.Sprintf("invalid table name %q", b.table))
+	}
+	L.Push(b.userData(L))
+	return 1
+}
+
+func (b *luaBuilder) userData(L *lua.LState) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = b
+	L.SetMetatable(ud, L.GetTypeMetatable(`builder_ud`))
+	return ud
+}
+
+func checkBuilder(L *lua.LState, n int) *luaBuilder {
+	ud := L.CheckUserData(n)
+	if v, ok := ud.Value.(*luaBuilder); ok {
+		return v
+	}
+	L.ArgError(n, "builder_ud expected")
+	return nil
+}
+
+func (b *luaBuilder) clone() *luaBuilder {
+	c := *b
+	c.where = slices.Clone(b.where)
+	c.args = slices.Clone(b.args)
+	c.order = slices.Clone(b.order)
+	c.returning = slices.Clone(b.returning)
+	return &c
+}
+
+// quote quotes an identifier for the driver.
+func (b *luaBuilder) quote(name string) string {
+	q := `"`
+	if b.driver == "mysql" {
+		q = "`"
+	}
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		if p != "*" {
+			parts[i] = q + p + q
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// column quotes name if it is an identifier and keeps expressions of the
+// builder, such as count(*), as they are. Columns given by scripts are
+// checked by columnArgs.
+func (b *luaBuilder) column(name string) string {
+	if identPattern.MatchString(name) {
+		return b.quote(name)
+	}
+	return name
+}
+
+// stringArgs reads the strings from n on, or an array of strings at n.
+func stringArgs(L *lua.LState, n int) []string {
+	var names []string
+	if t, ok := L.Get(n).(*lua.LTable); ok {
+		t.ForEach(func(_, v lua.LValue) {
+			names = append(names, v.String())
+		})
+		return names
+	}
+	for i := n; i <= L.GetTop(); i++ {
+		names = append(names, L.CheckString(i))
+	}
+	return names
+}
+
+// columnArgs reads the column names from n on, or an array of them at n.
+func columnArgs(L *lua.LState, n int) []string {
+	names := stringArgs(L, n)
+	for _, name := range names {
+		if !identPattern.MatchString(name) {
+			L.ArgError(n, fmt.Sprintf("invalid column name %q", name))
+		}
+	}
+	return names
+}
+
+// sortedKeys returns the string keys of t in order.
+func sortedKeys(L *lua.LState, t *lua.LTable, n int) []string {
+	var keys []string
+	t.ForEach(func(k, _ lua.LValue) {
+		s, ok := k.(lua.LString)
+		if !ok || !identPattern.MatchString(string(s)) {
+			L.ArgError(n, fmt.Sprintf("invalid column name %v", k))
+		}
+		keys = append(keys, string(s))
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+func checkArg(L *lua.LState, n int, name string, v lua.LValue) any {
+	arg, err := toArg(v)
+	if err != nil {
+		L.ArgError(n, fmt.Sprintf("%s: %v", name, err))
+	}
+	return arg
+}
+
+// BuilderWhere lua builder_ud:where(conditions) returns builder_ud
+// Conditions are a table of column=value, where an array value matches
+// any of its elements, or an SQL expression with ? placeholders and its
+// arguments. Conditions of several calls must all hold, so $n placeholders
+// are refused: the builder numbers them itself.
+func BuilderWhere(L *lua.LState) int {
+	b := checkBuilder(L, 1).clone()
+	if t, ok := L.Get(2).(*lua.LTable); ok {
+		for _, col := range sortedKeys(L, t, 2) {
+			v := t.RawGetString(col)
+			in, ok := v.(*lua.LTable)
+			if !ok {
+				b.where = append(b.where, b.quote(col)+" = ?")
+				b.args = append(b.args, checkArg(L, 2, col, v))
+				continue
+			}
+			if in.Len() == 0 {
+				b.where = append(b.where, "1 = 0")
+				continue
+			}
+			marks := make([]string, in.Len())
+			for i := range marks {
+				marks[i] = "?"
+				b.args = append(b.args, checkArg(L, 2, col, in.RawGetInt(i+1)))
+			}
+			b.where = append(b.where, b.quote(col)+" IN ("+strings.Join(marks, ", ")+")")
+		}
+	} else {
+		cond := L.CheckString(2)
+		if hasNumbered(b.driver, cond) {
+			L.ArgError(2, "use ? placeholders in where conditions, not $n")
+		}
+		b.where = append(b.where, "("+cond+")")
+		for i := 3; i <= L.GetTop(); i++ {
+			b.args = append(b.args, checkArg(L, i, "argument", L.Get(i)))
+		}
+	}
+	L.Push(b.userData(L))
+	return 1
+}
+
+// BuilderOrder lua builder_ud:order(...) returns builder_ud
+// Takes columns with an optional direction, such as "id desc".
+func BuilderOrder(L *lua.LState) int {
+	b := checkBuilder(L, 1).clone()
+	for _, o := range stringArgs(L, 2) {
+		m := orderPattern.FindStringSubmatch(strings.TrimSpace(o))
+		if m == nil {
+			L.ArgError(2, fmt.Sprintf("invalid order %q, use order_raw for expressions", o))
+		}
+		b.order = append(b.order, b.quote(m[1])+strings.ToUpper(m[2]))
+	}
+	L.Push(b.userData(L))
+	return 1
+}
+
+// BuilderOrderRaw lua builder_ud:order_raw(sql) returns builder_ud
+// Orders by an SQL expression, which is used as it is and must not
+// contain input of clients.
+//
+//	db:table("users"):order_raw("lower(name) asc"):select()
+func BuilderOrderRaw(L *lua.LState) int {
+	b := checkBuilder(L, 1).clone()
+	b.order = append(b.order, L.CheckString(2))
+	L.Push(b.userData(L))
+	return 1
+}
+
+// BuilderLimit lua builder_ud:limit(n) returns builder_ud
+func BuilderLimit(L *lua.LState) int {
+	b := checkBuilder(L, 1).clone()
+	b.limit = L.CheckInt(2)
+	L.Push(b.userData(L))
+	return 1
+}
+
+// BuilderOffset lua builder_ud:offset(n) returns builder_ud
+func BuilderOffset(L *lua.LState) int {
+	b := checkBuilder(L, 1).clone()
+	b.offset = L.CheckInt(2)
+	L.Push(b.userData(L))
+	return 1
+}
+
+// BuilderReturning lua builder_ud:returning(...) returns builder_ud
+// Inserts, updates and deletes return these columns of the rows they
+// change instead of the counts, not supported by mysql.
+func BuilderReturning(L *lua.LState) int {
+	b := checkBuilder(L, 1).clone()
+	b.returning = append(b.returning, columnArgs(L, 2)...)
+	L.Push(b.userData(L))
+	return 1
+}
+
+// BuilderTypes lua builder_ud:types(types) returns builder_ud
+func BuilderTypes(L *lua.LState) int {
+	b := checkBuilder(L, 1).clone()
+	types, err := b.types.merge(L.CheckTable(2))
+	if err != nil {
+		L.ArgError(2, err.Error())
+	}
+	b.types = types
+	L.Push(b.userData(L))
+	return 1
+}
+
+// BuilderTimeout lua builder_ud:timeout(seconds) returns builder_ud
+func BuilderTimeout(L *lua.LState) int {
+	b := checkBuilder(L, 1).clone()
+	if L.CheckNumber(2) < 0 {
+		L.ArgError(2, "timeout must not be negative")
+	}
+	b.timeout = seconds(float64(L.CheckNumber(2)))
+	L.Push(b.userData(L))
+	return 1
+}
+
+// session returns a session of a call with the timeout of the builder.
+func (b *luaBuilder) session(L *lua.LState) *session {
+	s := newSession(L, b.src)
+	s.timeout = b.timeout
+	return s
+}
+
+// whereSQL returns the WHERE clause, empty without conditions.
+func (b *luaBuilder) whereSQL() string {
+	if len(b.where) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(b.where, " AND ")
+}
+
+func (b *luaBuilder) selectSQL(columns []string) string {
+	cols := "*"
+	if len(columns) > 0 {
+		quoted := make([]string, len(columns))
+		for i, c := range columns {
+			quoted[i] = b.column(c)
+		}
+		cols = strings.Join(quoted, ", ")
+	}
+	var sb strings.Builder
+	sb.WriteString("SELECT " + cols + " FROM " + b.quote(b.table) + b.whereSQL())
+	if len(b.order) > 0 {
+		sb.WriteString(" ORDER BY " + strings.Join(b.order, ", "))
+	}
+	switch {
+	case b.limit >= 0:
+		sb.WriteString(" LIMIT " + strconv.Itoa(b.limit))
+	case b.offset < 0 || b.driver == "postgres":
+	case b.driver == "mysql":
+		// sqlite and mysql only take an offset after a limit
+		sb.WriteString(" LIMIT 18446744073709551615")
+	default:
+		sb.WriteString(" LIMIT -1")
+	}
+	if b.offset >= 0 {
+		sb.WriteString(" OFFSET " + strconv.Itoa(b.offset))
+	}
+	return sb.String()
+}
+
+func (b *luaBuilder) returningSQL() string {
+	if len(b.returning) == 0 {
+		return ""
+	}
+	cols := make([]string, len(b.returning))
+	for i, c := range b.returning {
+		cols[i] = b.column(c)
+	}
+	return " RETURNING " + strings.Join(cols, ", ")
+}
+
+// run runs a statement, returning its rows with RETURNING or else its
+// counts.
+func (b *luaBuilder) run(L *lua.LState, query string, args []any) lua.LValue {
+	query = rebind(L, b.driver, query+b.returningSQL())
+	s := b.session(L)
+	defer s.end()
+	if len(b.returning) > 0 {
+		sqlRows, m := s.query(L, query, args, b.types)
+		return s.collect(L, sqlRows, m)
+	}
+	return s.exec(L, query, args)
+}
+
+// BuilderSelect lua builder_ud:select(...) returns {{column=value}, ...}
+// Selects the given columns, all of them by default.
+func BuilderSelect(L *lua.LState) int {
+	b := checkBuilder(L, 1)
+	query := rebind(L, b.driver, b.selectSQL(columnArgs(L, 2)))
+	s := b.session(L)
+	defer s.end()
+	sqlRows, m := s.query(L, query, b.args, b.types)
+	L.Push(s.collect(L, sqlRows, m))
+	return 1
+}
+
+// BuilderFirst lua builder_ud:first(...) returns {column=value} or nil
+func BuilderFirst(L *lua.LState) int {
+	b := checkBuilder(L, 1).clone()
+	b.limit = 1
+	query := rebind(L, b.driver, b.selectSQL(columnArgs(L, 2)))
+	s := b.session(L)
+	defer s.end()
+	sqlRows, m := s.query(L, query, b.args, b.types)
+	rows := s.collect(L, sqlRows, m)
+	L.Push(rows.RawGetInt(1))
+	return 1
+}
+
+// BuilderCount lua builder_ud:count() returns number
+func BuilderCount(L *lua.LState) int {
+	b := checkBuilder(L, 1).clone()
+	b.order, b.limit, b.offset = nil, -1, -1
+	query := rebind(L, b.driver, b.selectSQL([]string{"COUNT(*) AS n"}))
+	s := b.session(L)
+	defer s.end()
+	sqlRows, m := s.query(L, query, b.args, b.types)
+	rows := s.collect(L, sqlRows, m)
+	L.Push(rows.RawGetInt(1).(*lua.LTable).RawGetString("n"))
+	return 1
+}
+
+// insertArgs reads the row or array of rows at n. It returns the columns
+// of all rows, in order, the number of rows and the values of each row for
+// the columns, NULL for the columns a row lacks.
+func (b *luaBuilder) insertArgs(L *lua.LState, n int) ([]string, int, []any) {
+	t := L.CheckTable(n)
+	rows := []*lua.LTable{t}
+	if t.Len() > 0 {
+		rows = rows[:0]
+		t.ForEach(func(_, v lua.LValue) {
+			row, ok := v.(*lua.LTable)
+			if !ok {
+				L.ArgError(n, "row table expected")
+			}
+			rows = append(rows, row)
+		})
+	}
+	seen := make(map[string]bool)
+	var cols []string
+	for _, row := range rows {
+		for _, c := range sortedKeys(L, row, n) {
+			if !seen[c] {
+				seen[c] = true
+				cols = append(cols, c)
+			}
+		}
+	}
+	if len(cols) == 0 {
+		L.ArgError(n, "no columns to insert")
+	}
+	sort.Strings(cols)
+	var args []any
+	for _, row := range rows {
+		for _, c := range cols {
+			args = append(args, checkArg(L, n, c, row.RawGetString(c)))
+		}
+	}
+	return cols, len(rows), args
+}
+
+// insertSQL returns the INSERT statement of rows rows of cols.
+func (b *luaBuilder) insertSQL(cols []string, rows int) string {
+	quoted := make([]string, len(cols))
+	marks := make([]string, len(cols))
+	for i, c := range cols {
+		quoted[i] = b.quote(c)
+		marks[i] = "?"
+	}
+	values := make([]string, rows)
+	for i := range values {
+		values[i] = "(" + strings.Join(marks, ", ") + ")"
+	}
+	return "INSERT INTO " + b.quote(b.table) + " (" + strings.Join(quoted, ", ") + ") VALUES " + strings.Join(values, ", ")
+}
+
+// BuilderInsert lua builder_ud:insert(row) returns {rows_affected=number, last_insert_id=number}
+// Takes a table of column=value or an array of them.
+func BuilderInsert(L *lua.LState) int {
+	b := checkBuilder(L, 1)
+	cols, rows, args := b.insertArgs(L, 2)
+	L.Push(b.run(L, b.insertSQL(cols, rows), args))
+	return 1
+}
+
+// BuilderUpsert lua builder_ud:upsert(row, conflict) returns {rows_affected=number, last_insert_id=number}
+// Inserts rows or updates the other columns of rows that conflict on the
+// unique columns in conflict, which mysql takes from the table's keys.
+func BuilderUpsert(L *lua.LState) int {
+	b := checkBuilder(L, 1)
+	cols, rows, args := b.insertArgs(L, 2)
+	conflict := columnArgs(L, 3)
+	if len(conflict) == 0 && b.driver != "mysql" {
+		L.ArgError(3, "conflict columns expected")
+	}
+	L.Push(b.run(L, b.upsertSQL(cols, rows, conflict), args))
+	return 1
+}
+
+// upsertSQL returns the INSERT statement of rows rows of cols that updates
+// the columns not in conflict of the rows already there.
+func (b *luaBuilder) upsertSQL(cols []string, rows int, conflict []string) string {
+	query := b.insertSQL(cols, rows)
+	var update []string
+	for _, c := range cols {
+		if !slices.Contains(conflict, c) {
+			update = append(update, c)
+		}
+	}
+	if b.driver == "mysql" {
+		if len(update) == 0 {
+			// keeps the row
+			update = cols[:1]
+		}
+		sets := make([]string, len(update))
+		for i, c := range update {
+			sets[i] = b.quote(c) + " = VALUES(" + b.quote(c) + ")"
+		}
+		return query + " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+	}
+	target := make([]string, len(conflict))
+	for i, c := range conflict {
+		target[i] = b.quote(c)
+	}
+	query += " ON CONFLICT (" + strings.Join(target, ", ") + ")"
+	if len(update) == 0 {
+		return query + " DO NOTHING"
+	}
+	sets := make([]string, len(update))
+	for i, c := range update {
+		sets[i] = b.quote(c) + " = excluded." + b.quote(c)
+	}
+	return query + " DO UPDATE SET " + strings.Join(sets, ", ")
+}
+
+// checkWhere refuses statements on every row of the table.
+func (b *luaBuilder) checkWhere(L *lua.LState, op string) {
+	if len(b.where) == 0 {
+		L.RaiseError("%s without where would change every row of %s, use where(\"1 = 1\") to do so", op, b.table)
+	}
+}
+
+// BuilderUpdate lua builder_ud:update(values) returns {rows_affected=number, last_insert_id=number}
+func BuilderUpdate(L *lua.LState) int {
+	b := checkBuilder(L, 1)
+	b.checkWhere(L, "update")
+	t := L.CheckTable(2)
+	cols := sortedKeys(L, t, 2)
+	if len(cols) == 0 {
+		L.ArgError(2, "no columns to update")
+	}
+	var args []any
+	for _, c := range cols {
+		args = append(args, checkArg(L, 2, c, t.RawGetString(c)))
+	}
+	L.Push(b.run(L, b.updateSQL(cols), append(args, b.args...)))
+	return 1
+}
+
+// updateSQL returns the UPDATE statement setting cols, whose values come
+// before the arguments of the conditions.
+func (b *luaBuilder) updateSQL(cols []string) string {
+	sets := make([]string, len(cols))
+	for i, c := range cols {
+		sets[i] = b.quote(c) + " = ?"
+	}
+	return "UPDATE " + b.quote(b.table) + " SET " + strings.Join(sets, ", ") + b.whereSQL()
+}
+
+// BuilderDelete lua builder_ud:delete() returns {rows_affected=number, last_insert_id=number}
+func BuilderDelete(L *lua.LState) int {
+	b := checkBuilder(L, 1)
+	b.checkWhere(L, "delete")
+	L.Push(b.run(L, b.deleteSQL(), b.args))
+	return 1
+}
+
+func (b *luaBuilder) deleteSQL() string {
+	return "DELETE FROM " + b.quote(b.table) + b.whereSQL()
+}
@@ -0,0 +1,135 @@
+package odbc
+
+import (
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// call calls the builder method fn on b with args and returns the builder
+// it returns, or the error it raises.
+func call(L *lua.LState, fn lua.LGFunction, b *luaBuilder, args ...lua.LValue) (*luaBuilder, error) {
+	L.Push(L.NewFunction(fn))
+	L.Push(b.userData(L))
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	if err := L.PCall(len(args)+1, 1, nil); err != nil {
+		return nil, err
+	}
+	ud := L.Get(-1).(*lua.LUserData)
+	L.Pop(1)
+	return ud.Value.(*luaBuilder), nil
+}
+
+func TestBuilderSQL(t *testing.T) {
+	tests := []struct {
+		driver                        string
+		selectSQL, offset             string
+		insert, upsert, upsertNothing string
+		update, delete                string
+	}{
+		{
+			driver:        "sqlite3",
+			selectSQL:     `SELECT "id", "name" FROM "users" WHERE "active" = ? AND "id" IN (?, ?) AND (age > ? OR name = ?) ORDER BY "id" DESC LIMIT 10 OFFSET 20`,
+			offset:        `SELECT * FROM "users" LIMIT -1 OFFSET 5`,
+			insert:        `INSERT INTO "users" ("age", "name") VALUES (?, ?), (?, ?) RETURNING "id"`,
+			upsert:        `INSERT INTO "users" ("email", "name") VALUES (?, ?) ON CONFLICT ("email") DO UPDATE SET "name" = excluded."name"`,
+			upsertNothing: `INSERT INTO "users" ("email", "name") VALUES (?, ?) ON CONFLICT ("email", "name") DO NOTHING`,
+			update:        `UPDATE "users" SET "name" = ? WHERE "active" = ? AND "id" IN (?, ?) AND (age > ? OR name = ?)`,
+			delete:        `DELETE FROM "users" WHERE "active" = ? AND "id" IN (?, ?) AND (age > ? OR name = ?) RETURNING "id"`,
+		},
+		{
+			driver:        "postgres",
+			selectSQL:     `SELECT "id", "name" FROM "users" WHERE "active" = $1 AND "id" IN ($2, $3) AND (age > $4 OR name = $5) ORDER BY "id" DESC LIMIT 10 OFFSET 20`,
+			offset:        `SELECT * FROM "users" OFFSET 5`,
+			insert:        `INSERT INTO "users" ("age", "name") VALUES ($1, $2), ($3, $4) RETURNING "id"`,
+			upsert:        `INSERT INTO "users" ("email", "name") VALUES ($1, $2) ON CONFLICT ("email") DO UPDATE SET "name" = excluded."name"`,
+			upsertNothing: `INSERT INTO "users" ("email", "name") VALUES ($1, $2) ON CONFLICT ("email", "name") DO NOTHING`,
+			update:        `UPDATE "users" SET "name" = $1 WHERE "active" = $2 AND "id" IN ($3, $4) AND (age > $5 OR name = $6)`,
+			delete:        `DELETE FROM "users" WHERE "active" = $1 AND "id" IN ($2, $3) AND (age > $4 OR name = $5) RETURNING "id"`,
+		},
+		{
+			driver:        "mysql",
+			selectSQL:     "SELECT `id`, `name` FROM `users` WHERE `active` = ? AND `id` IN (?, ?) AND (age > ? OR name = ?) ORDER BY `id` DESC LIMIT 10 OFFSET 20",
+			offset:        "SELECT * FROM `users` LIMIT 18446744073709551615 OFFSET 5",
+			insert:        "INSERT INTO `users` (`age`, `name`) VALUES (?, ?), (?, ?) RETURNING `id`",
+			upsert:        "INSERT INTO `users` (`email`, `name`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `name` = VALUES(`name`)",
+			upsertNothing: "INSERT INTO `users` (`email`, `name`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `email` = VALUES(`email`)",
+			update:        "UPDATE `users` SET `name` = ? WHERE `active` = ? AND `id` IN (?, ?) AND (age > ? OR name = ?)",
+			delete:        "DELETE FROM `users` WHERE `active` = ? AND `id` IN (?, ?) AND (age > ? OR name = ?) RETURNING `id`",
+		},
+	}
+	L := lua.NewState()
+	defer L.Close()
+	for _, tt := range tests {
+		t.Run(tt.driver, func(t *testing.T) {
+			check := func(name, query, want string) {
+				t.Helper()
+				got, err := rewritePositional(tt.driver, query)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if got != want {
+					t.Errorf("%s:\n got %s\nwant %s", name, got, want)
+				}
+			}
+			base := &luaBuilder{driver: tt.driver, table: "users", limit: -1, offset: -1}
+			cond := L.NewTable()
+			cond.RawSetString("active", lua.LTrue)
+			cond.RawSetString("id", L.NewTable())
+			cond.RawGetString("id").(*lua.LTable).Append(lua.LNumber(1))
+			cond.RawGetString("id").(*lua.LTable).Append(lua.LNumber(2))
+			b, err := call(L, BuilderWhere, base, cond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err = call(L, BuilderWhere, b, lua.LString("age > ? OR name = ?"), lua.LNumber(18), lua.LString("bob"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b.args) != 5 {
+				t.Errorf("got %d arguments, want 5", len(b.args))
+			}
+
+			sel, err := call(L, BuilderOrder, b, lua.LString("id desc"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sel.limit, sel.offset = 10, 20
+			check("select", sel.selectSQL([]string{"id", "name"}), tt.selectSQL)
+			off := base.clone()
+			off.offset = 5
+			check("offset", off.selectSQL(nil), tt.offset)
+
+			ret := base.clone()
+			ret.returning = []string{"id"}
+			check("insert", ret.insertSQL([]string{"age", "name"}, 2)+ret.returningSQL(), tt.insert)
+			check("upsert", base.upsertSQL([]string{"email", "name"}, 1, []string{"email"}), tt.upsert)
+			check("upsert nothing", base.upsertSQL([]string{"email", "name"}, 1, []string{"email", "name"}), tt.upsertNothing)
+			check("update", b.updateSQL([]string{"name"}), tt.update)
+			del := b.clone()
+			del.returning = []string{"id"}
+			check("delete", del.deleteSQL()+del.returningSQL(), tt.delete)
+		})
+	}
+}
+
+func TestBuilderWhereNumbered(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	b := &luaBuilder{driver: "postgres", table: "users", limit: -1, offset: -1}
+	_, err := call(L, BuilderWhere, b, lua.LString("id = $1"), lua.LNumber(1))
+	if err == nil || !strings.Contains(err.Error(), "use ? placeholders") {
+		t.Errorf("got %v, want an error about $n placeholders", err)
+	}
+	b, err = call(L, BuilderWhere, b, lua.LString("data ?? 'k' AND note <> '$1'"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := rewritePositional(b.driver, b.selectSQL(nil))
+	if want := `SELECT * FROM "users" WHERE (data ? 'k' AND note <> '$1')`; err != nil || got != want {
+		t.Errorf("got %q, %v, want %q", got, err, want)
+	}
+}
@@ -0,0 +1,63 @@
+package odbc
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Connections held by the cursors and transactions of a state, which keep
+// them while Lua runs. A state holding every connection of a database,
+// such as the single one of an in-memory sqlite database, would wait for
+// itself forever, so its calls on the database raise an error instead.
+var (
+	held     = make(map[heldKey]int)
+	heldLock = &sync.Mutex{}
+)
+
+type heldKey struct {
+	L  *lua.LState
+	db *sql.DB
+}
+
+// hold records a connection of db held by L. The returned function
+// releases it, it is also called once ctx is done since the database then
+// rolls back the transaction holding the connection.
+func hold(L *lua.LState, db *sql.DB, ctx context.Context) func() {
+	k := heldKey{L, db}
+	heldLock.Lock()
+	held[k]++
+	heldLock.Unlock()
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			heldLock.Lock()
+			defer heldLock.Unlock()
+			if held[k]--; held[k] <= 0 {
+				delete(held, k)
+			}
+		})
+	}
+	stop := context.AfterFunc(ctx, release)
+	return func() {
+		stop()
+		release()
+	}
+}
+
+// checkFree raises an error if L holds every connection of db, so that a
+// call would never get one.
+func checkFree(L *lua.LState, db *sql.DB) {
+	max := db.Stats().MaxOpenConnections
+	if max <= 0 {
+		return
+	}
+	heldLock.Lock()
+	n := held[heldKey{L, db}]
+	heldLock.Unlock()
+	if n >= max {
+		L.RaiseError("db: all %d connections are held by open cursors or transactions of this script, close them or run the statement on the transaction", max)
+	}
+}
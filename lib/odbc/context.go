@@ -0,0 +1,127 @@
+package odbc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Prefixes of the errors raised to Lua when a statement is stopped, so
+// that scripts can tell them from failed statements.
+const (
+	// the timeout of the database or the call passed
+	TimeoutError = "db timeout"
+	// the request was canceled, e.g. its client disconnected
+	CanceledError = "db canceled"
+)
+
+// Client is the client of the request a state serves. Its database calls
+// stop once the context returned by Left is done, e.g. when the client
+// disconnects, while the rest of the script keeps running.
+type Client interface {
+	Left() context.Context
+}
+
+type clientKey struct{}
+
+// WithClient returns ctx carrying c, see Client.
+func WithClient(ctx context.Context, c Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, c)
+}
+
+// callContext returns the context of a call: the context of L, which is
+// canceled with the request it serves or when its client leaves, limited
+// to timeout if it is not 0.
+func callContext(L *lua.LState, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := clientContext(L)
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// stateContext returns the context of L, or the background context if it
+// has none, canceled when its client leaves. It is used by transactions,
+// which live as long as L does.
+func stateContext(L *lua.LState) context.Context {
+	ctx, _ := clientContext(L)
+	return ctx
+}
+
+// clientContext returns the context of L, or the background context if it
+// has none, canceled when the client of L leaves, and a function that
+// stops watching the client.
+func clientContext(L *lua.LState) (context.Context, func()) {
+	ctx := L.Context()
+	if ctx == nil {
+		return context.Background(), func() {}
+	}
+	c, ok := ctx.Value(clientKey{}).(Client)
+	if !ok {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(c.Left(), cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// seconds converts a timeout in seconds.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// checkTimeout returns the timeout option of the query table at n, in
+// seconds, or def.
+//
+//	{"select ...", timeout=1.5}
+func checkTimeout(L *lua.LState, n int, def time.Duration) time.Duration {
+	t, ok := L.Get(n).(*lua.LTable)
+	if !ok {
+		return def
+	}
+	switch v := t.RawGetString("timeout").(type) {
+	case *lua.LNilType:
+		return def
+	case lua.LNumber:
+		if v < 0 {
+			L.ArgError(n, "timeout must not be negative")
+		}
+		return seconds(float64(v))
+	default:
+		L.ArgError(n, "timeout must be number")
+	}
+	return def
+}
+
+// raise raises err to Lua, see dbError.
+func raise(L *lua.LState, ctx context.Context, err error) {
+	L.RaiseError("%v", dbError(ctx, err))
+}
+
+// dbError returns err with a distinct message if the statement was
+// stopped by ctx. Drivers do not always return the error of the context,
+// so ctx is checked as well.
+func dbError(ctx context.Context, err error) error {
+	if cerr := ctx.Err(); cerr != nil && !errors.Is(err, cerr) {
+		err = fmt.Errorf("%w (%v)", cerr, err)
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("%s: %w", TimeoutError, err)
+	case errors.Is(err, context.Canceled):
+		return fmt.Errorf("%s: %w", CanceledError, err)
+	}
+	return err
+}
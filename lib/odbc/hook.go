@@ -0,0 +1,186 @@
+package odbc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Event describes a statement run by a database.
+type Event struct {
+	// context of the calling state, nil if it has none
+	Context context.Context
+	// query, exec, command, stmt_query or stmt_exec
+	Op    string
+	Query string
+	// number of bind arguments
+	Args     int
+	Start    time.Time
+	Duration time.Duration
+	// rows read by queries or changed by statements, -1 if unknown
+	Rows int64
+	Err  error
+}
+
+var (
+	hooks     []func(Event)
+	hooksLock = &sync.RWMutex{}
+)
+
+// AddHook calls fn after every statement. It is called on the goroutine
+// of the statement.
+func AddHook(fn func(Event)) {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+
+	hooks = append(hooks, fn)
+}
+
+// observation times a statement and reports it to the hooks.
+type observation struct {
+	L     *lua.LState
+	hooks *luaHooks
+	ev    Event
+}
+
+// observe starts timing a statement with args bind arguments. Defer the
+// done method of the returned observation so that it also sees errors
+// raised to Lua. hooks are the Lua hooks of the database, may be nil.
+func observe(L *lua.LState, hooks *luaHooks, op, query string, args int) *observation {
+	return &observation{
+		L:     L,
+		hooks: hooks,
+		ev: Event{
+			Context: L.Context(),
+			Op:      op,
+			Query:   query,
+			Args:    args,
+			Start:   time.Now(),
+			Rows:    -1,
+		},
+	}
+}
+
+// result records the rows of a {rows = {}} or {rows_affected=number}
+// result.
+func (o *observation) result(t *lua.LTable) {
+	if rows, ok := t.RawGetString(`rows`).(*lua.LTable); ok {
+		o.ev.Rows = int64(rows.Len())
+	} else if n, ok := t.RawGetString(`rows_affected`).(lua.LNumber); ok {
+		o.ev.Rows = int64(n)
+	}
+}
+
+func (o *observation) done() {
+	o.finish(recover())
+}
+
+// finish reports the statement, which raised r if it is not nil, and
+// raises r again.
+func (o *observation) finish(r any) {
+	o.ev.Duration = time.Since(o.ev.Start)
+	if r != nil && o.ev.Err == nil {
+		o.ev.Err = fmt.Errorf("%v", r)
+	}
+	hooksLock.RLock()
+	for _, fn := range hooks {
+		fn(o.ev)
+	}
+	hooksLock.RUnlock()
+	herr := o.hooks.call(o.L, o.ev)
+	if r != nil {
+		panic(r)
+	}
+	if herr != nil {
+		o.L.RaiseError("db hook: %v", herr)
+	}
+}
+
+// luaHooks are the Lua functions called after the statements of a
+// database, see On.
+type luaHooks struct {
+	sync.RWMutex
+	query []*lua.LFunction
+}
+
+// Events accepted by db_ud:on.
+var hookEvents = []string{"query"}
+
+// states running a hook, whose statements are not reported to hooks again
+var inHook sync.Map
+
+// call calls the query hooks with the event, on L. It returns the first
+// error raised by a hook.
+func (h *luaHooks) call(L *lua.LState, ev Event) error {
+	if h == nil {
+		return nil
+	}
+	h.RLock()
+	fns := h.query
+	h.RUnlock()
+	if len(fns) == 0 {
+		return nil
+	}
+	if _, loaded := inHook.LoadOrStore(L, true); loaded {
+		return nil
+	}
+	defer inHook.Delete(L)
+	t := L.CreateTable(0, 6)
+	t.RawSetString(`op`, lua.LString(ev.Op))
+	t.RawSetString(`query`, lua.LString(ev.Query))
+	t.RawSetString(`args`, lua.LNumber(ev.Args))
+	t.RawSetString(`duration`, lua.LNumber(ev.Duration.Seconds()))
+	if ev.Rows >= 0 {
+		t.RawSetString(`rows`, lua.LNumber(ev.Rows))
+	}
+	if ev.Err != nil {
+		t.RawSetString(`error`, lua.LString(ev.Err.Error()))
+	}
+	for _, fn := range fns {
+		L.Push(fn)
+		L.Push(t)
+		if err := L.PCall(1, 0, nil); err != nil {
+			if lerr, ok := err.(*lua.ApiError); ok {
+				return errors.New(lerr.Object.String())
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// On lua db_ud:on(event, fn)
+// Calls fn after every statement of the database, with a table:
+//
+//	{
+//	  op="query", -- exec, command, stmt_query or stmt_exec
+//	  query="select ...",
+//	  args=1, -- number of bind arguments
+//	  duration=0.002, -- seconds
+//	  rows=10, -- read or changed, nil if unknown
+//	  error=nil
+//	}
+//
+// Statements run by fn itself are not reported. An error raised by fn is
+// raised by the statement, after it has run. Hooks belong to the db_ud
+// they are added to, databases opened in shared mode share only their
+// connections.
+func On(L *lua.LState) int {
+	dbInterface := checkDB(L, 1)
+	event := L.CheckString(2)
+	fn := L.CheckFunction(3)
+	if !slices.Contains(hookEvents, event) {
+		L.ArgError(2, fmt.Sprintf("unknown event %q, expected one of %s", event, strings.Join(hookEvents, ", ")))
+	}
+	h := dbInterface.getHooks()
+	h.Lock()
+	defer h.Unlock()
+	h.query = append(h.query, fn)
+	return 0
+}
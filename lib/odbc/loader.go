@@ -16,11 +16,44 @@ func Preload(L *lua.LState) {
 func Loader(L *lua.LState) int {
 	db_ud := L.NewTypeMetatable(`db_ud`)
 	L.SetField(db_ud, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
-		"query":   Query,
-		"exec":    Exec,
-		"stmt":    Stmt,
-		"command": Command,
-		"close":   Close,
+		"query":       Query,
+		"exec":        Exec,
+		"stmt":        Stmt,
+		"command":     Command,
+		"begin":       Begin,
+		"transaction": Transaction,
+		"rows":        Rows,
+		"one":         One,
+		"scalar":      Scalar,
+		"each":        Each,
+		"cursor":      Cursor,
+		"table":       Table,
+		"stats":       Stats,
+		"on":          On,
+		"close":       Close,
+	}))
+
+	tx_ud := L.NewTypeMetatable(`tx_ud`)
+	L.SetField(tx_ud, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"query":       TxQuery,
+		"exec":        TxExec,
+		"stmt":        TxStmt,
+		"commit":      TxCommit,
+		"rollback":    TxRollback,
+		"transaction": TxTransaction,
+		"rows":        Rows,
+		"one":         One,
+		"scalar":      Scalar,
+		"each":        Each,
+		"cursor":      Cursor,
+		"table":       Table,
+	}))
+
+	cursor_ud := L.NewTypeMetatable(`cursor_ud`)
+	L.SetField(cursor_ud, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"next":  CursorNext,
+		"rows":  CursorRows,
+		"close": CursorClose,
 	}))
 
 	stmt_ud := L.NewTypeMetatable(`stmt_ud`)
@@ -30,6 +63,25 @@ func Loader(L *lua.LState) int {
 		"close": StmtClose,
 	}))
 
+	builder_ud := L.NewTypeMetatable(`builder_ud`)
+	L.SetField(builder_ud, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"where":     BuilderWhere,
+		"order":     BuilderOrder,
+		"order_raw": BuilderOrderRaw,
+		"limit":     BuilderLimit,
+		"offset":    BuilderOffset,
+		"returning": BuilderReturning,
+		"types":     BuilderTypes,
+		"timeout":   BuilderTimeout,
+		"select":    BuilderSelect,
+		"first":     BuilderFirst,
+		"count":     BuilderCount,
+		"insert":    BuilderInsert,
+		"upsert":    BuilderUpsert,
+		"update":    BuilderUpdate,
+		"delete":    BuilderDelete,
+	}))
+
 	t := L.NewTable()
 	L.SetFuncs(t, api)
 	L.Push(t)
@@ -0,0 +1,264 @@
+package odbc
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/vadv/gopher-lua-libs/json"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Types controls how column values are returned to Lua. The zero value
+// uses the first choice of every field.
+type Types struct {
+	// rfc3339, unix (float seconds) or table (os.date("*t") fields)
+	Time string `lua:"time"`
+	// string or number
+	Decimal string `lua:"decimal"`
+	// table (decoded) or string
+	JSON string `lua:"json"`
+	// integers beyond 2^53: string or number
+	BigInt string `lua:"bigint"`
+}
+
+// Known choices of the fields of Types, the first one is the default.
+var typeChoices = map[string][]string{
+	"time":    {"rfc3339", "unix", "table"},
+	"decimal": {"string", "number"},
+	"json":    {"table", "string"},
+	"bigint":  {"string", "number"},
+}
+
+func (t *Types) fields() map[string]*string {
+	return map[string]*string{
+		"time":    &t.Time,
+		"decimal": &t.Decimal,
+		"json":    &t.JSON,
+		"bigint":  &t.BigInt,
+	}
+}
+
+// Check reports an unknown choice.
+func (t Types) Check() error {
+	for name, v := range t.fields() {
+		if *v == "" {
+			continue
+		}
+		known := false
+		for _, c := range typeChoices[name] {
+			known = known || c == *v
+		}
+		if !known {
+			return fmt.Errorf("unknown %s type %q, expected one of %s", name, *v, strings.Join(typeChoices[name], ", "))
+		}
+	}
+	return nil
+}
+
+// merge returns t with the fields of the options table o that are set.
+func (t Types) merge(o *lua.LTable) (Types, error) {
+	for name, v := range t.fields() {
+		if s := o.RawGetString(name); s != lua.LNil {
+			*v = s.String()
+		}
+	}
+	return t, t.Check()
+}
+
+// checkQuery returns the query at n, either a string or a table of the
+// query and the types of its results:
+//
+//	{"select ...", time="unix"}
+func checkQuery(L *lua.LState, n int, types Types) (string, Types) {
+	t, ok := L.Get(n).(*lua.LTable)
+	if !ok {
+		return L.CheckString(n), types
+	}
+	query, ok := t.RawGetInt(1).(lua.LString)
+	if !ok {
+		L.ArgError(n, "query expected as the first element")
+	}
+	types, err := types.merge(t)
+	if err != nil {
+		L.ArgError(n, err.Error())
+	}
+	return string(query), types
+}
+
+// mapper converts the values of the columns of a result to Lua.
+type mapper struct {
+	L     *lua.LState
+	types Types
+	cols  []string
+	// database type names, upper case without length or precision
+	dbTypes []string
+}
+
+func newMapper(L *lua.LState, sqlRows *sql.Rows, types Types) (*mapper, error) {
+	cts, err := sqlRows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	m := &mapper{L: L, types: types}
+	for _, ct := range cts {
+		name := strings.ToUpper(ct.DatabaseTypeName())
+		if i := strings.IndexByte(name, '('); i >= 0 {
+			name = strings.TrimSpace(name[:i])
+		}
+		m.cols = append(m.cols, ct.Name())
+		m.dbTypes = append(m.dbTypes, name)
+	}
+	return m, nil
+}
+
+// row returns the values of a row as a table keyed by column name.
+func (m *mapper) row(values []any) *lua.LTable {
+	row := m.L.CreateTable(0, len(m.cols))
+	for i, col := range m.cols {
+		row.RawSetString(col, m.value(i, values[i]))
+	}
+	return row
+}
+
+// value converts the value of column i.
+func (m *mapper) value(i int, value any) lua.LValue {
+	dbType := m.dbTypes[i]
+	switch v := value.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case int64:
+		return m.integer(v)
+	case uint64:
+		return m.unsigned(v)
+	case float64:
+		if isDecimal(dbType) && m.types.Decimal != "number" {
+			return lua.LString(strconv.FormatFloat(v, 'f', -1, 64))
+		}
+		return lua.LNumber(v)
+	case time.Time:
+		return m.time(v)
+	case string:
+		return m.text(dbType, []byte(v))
+	case []byte:
+		return m.text(dbType, v)
+	default:
+		return lua.LString(fmt.Sprint(v))
+	}
+}
+
+// integer keeps integers that a float64 cannot hold exactly as strings.
+func (m *mapper) integer(v int64) lua.LValue {
+	if (v > 1<<53 || v < -(1<<53)) && m.types.BigInt != "number" {
+		return lua.LString(strconv.FormatInt(v, 10))
+	}
+	return lua.LNumber(v)
+}
+
+func (m *mapper) unsigned(v uint64) lua.LValue {
+	if v > math.MaxInt64 {
+		if m.types.BigInt == "number" {
+			return lua.LNumber(v)
+		}
+		return lua.LString(strconv.FormatUint(v, 10))
+	}
+	return m.integer(int64(v))
+}
+
+func (m *mapper) time(t time.Time) lua.LValue {
+	switch m.types.Time {
+	case "unix":
+		return lua.LNumber(float64(t.UnixNano()) / float64(time.Second))
+	case "table":
+		tbl := m.L.CreateTable(0, 10)
+		tbl.RawSetString("year", lua.LNumber(t.Year()))
+		tbl.RawSetString("month", lua.LNumber(t.Month()))
+		tbl.RawSetString("day", lua.LNumber(t.Day()))
+		tbl.RawSetString("hour", lua.LNumber(t.Hour()))
+		tbl.RawSetString("min", lua.LNumber(t.Minute()))
+		tbl.RawSetString("sec", lua.LNumber(t.Second()))
+		tbl.RawSetString("nsec", lua.LNumber(t.Nanosecond()))
+		tbl.RawSetString("wday", lua.LNumber(t.Weekday()+1))
+		tbl.RawSetString("yday", lua.LNumber(t.YearDay()))
+		tbl.RawSetString("zone", lua.LString(t.Location().String()))
+		tbl.RawSetString("unix", lua.LNumber(float64(t.UnixNano())/float64(time.Second)))
+		return tbl
+	}
+	return lua.LString(t.Format(time.RFC3339Nano))
+}
+
+// Layouts of mysql dates and times sent as text.
+var textTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// text converts a value the driver returned as text or bytes by the type
+// of its column. Unknown types, such as BLOBs, are returned as is.
+func (m *mapper) text(dbType string, b []byte) lua.LValue {
+	switch {
+	case dbType == "JSON" || dbType == "JSONB":
+		if m.types.JSON == "string" {
+			break
+		}
+		v, err := json.ValueDecode(m.L, b)
+		if err != nil {
+			break
+		}
+		return v
+	case isDecimal(dbType):
+		if m.types.Decimal != "number" {
+			break
+		}
+		if f, err := strconv.ParseFloat(string(b), 64); err == nil {
+			return lua.LNumber(f)
+		}
+	case isInteger(dbType):
+		if i, err := strconv.ParseInt(string(b), 10, 64); err == nil {
+			return m.integer(i)
+		}
+		if u, err := strconv.ParseUint(string(b), 10, 64); err == nil {
+			return m.unsigned(u)
+		}
+	case dbType == "FLOAT" || dbType == "DOUBLE" || dbType == "REAL":
+		if f, err := strconv.ParseFloat(string(b), 64); err == nil {
+			return lua.LNumber(f)
+		}
+	case dbType == "DATETIME" || dbType == "TIMESTAMP" || dbType == "DATE":
+		for _, layout := range textTimeLayouts {
+			if t, err := time.Parse(layout, string(b)); err == nil {
+				return m.time(t)
+			}
+		}
+	case strings.HasPrefix(dbType, "_"):
+		// postgres array
+		var arr []string
+		if err := pq.Array(&arr).Scan(b); err != nil {
+			break
+		}
+		tbl := m.L.CreateTable(len(arr), 0)
+		for _, v := range arr {
+			tbl.Append(lua.LString(v))
+		}
+		return tbl
+	}
+	return lua.LString(b)
+}
+
+func isDecimal(dbType string) bool {
+	return dbType == "DECIMAL" || dbType == "NUMERIC"
+}
+
+func isInteger(dbType string) bool {
+	switch strings.TrimPrefix(dbType, "UNSIGNED ") {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "INTEGER", "BIGINT":
+		return true
+	}
+	return false
+}
@@ -2,43 +2,55 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"database/sql"
 	_ "embed"
+	"encoding/json"
 	"fmt"
+	"io/fs"
 	"net"
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	lhttp "github.com/cloudwindy/mirai/lib/http"
+	"github.com/cloudwindy/mirai/lib/odbc"
 	"github.com/cloudwindy/mirai/pkg/admin"
 	"github.com/cloudwindy/mirai/pkg/config"
 	"github.com/cloudwindy/mirai/pkg/daemon"
 	"github.com/cloudwindy/mirai/pkg/dir"
+	"github.com/cloudwindy/mirai/pkg/health"
 	"github.com/cloudwindy/mirai/pkg/leapp"
 	"github.com/cloudwindy/mirai/pkg/lecli"
 	"github.com/cloudwindy/mirai/pkg/ledb"
+	"github.com/cloudwindy/mirai/pkg/lelog"
+	"github.com/cloudwindy/mirai/pkg/lemetrics"
+	"github.com/cloudwindy/mirai/pkg/listener"
+	"github.com/cloudwindy/mirai/pkg/logging"
 	"github.com/cloudwindy/mirai/pkg/lue"
+	"github.com/cloudwindy/mirai/pkg/lut"
+	lutpool "github.com/cloudwindy/mirai/pkg/lut/pool"
+	"github.com/cloudwindy/mirai/pkg/metrics"
+	"github.com/cloudwindy/mirai/pkg/middleware"
+	"github.com/cloudwindy/mirai/pkg/store"
 	"github.com/cloudwindy/mirai/pkg/timer"
+	"github.com/cloudwindy/mirai/pkg/trace"
 	"github.com/fatih/color"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cache"
-	"github.com/gofiber/fiber/v2/middleware/compress"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/favicon"
-	"github.com/gofiber/fiber/v2/middleware/limiter"
-	"github.com/gofiber/fiber/v2/middleware/logger"
-	"github.com/gofiber/fiber/v2/middleware/pprof"
 	"github.com/gofiber/fiber/v2/middleware/recover"
-	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/gofiber/fiber/v2/middleware/session"
-	sbolt "github.com/gofiber/storage/bbolt"
 	"github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli/v3"
+	lua "github.com/yuin/gopher-lua"
 )
 
 // Package info
@@ -85,9 +97,19 @@ var (
 	}
 )
 
-var DefaultPidFile = "mirai.pid"
+var (
+	DefaultPidFile = "mirai.pid"
+	// named after a hash of the project directory
+	DefaultControlFile = "mirai-%x.sock"
+)
 
 func main() {
+	config.Warnf = func(format string, a ...any) {
+		// workers parse the manifest again
+		if !daemon.IsChild() {
+			warn("warn: "+format+"\n", a...)
+		}
+	}
 	app := new(cli.Command)
 	app.Usage = "Server for the Mirai Project"
 	app.Version = fmt.Sprintf("%s %s", version, build)
@@ -102,6 +124,11 @@ func main() {
 			Value:   ".",
 			Sources: cli.Files("."),
 		},
+		&cli.StringFlag{
+			Name:    "profile",
+			Usage:   "layer project.<profile>.lua and .env.<profile> over the project",
+			Sources: cli.EnvVars(config.EnvProfile),
+		},
 		&cli.BoolFlag{
 			Name:    "interactive",
 			Aliases: []string{"i"},
@@ -124,10 +151,71 @@ func main() {
 			ArgsUsage: "arguments are passed to Lua scripts without parsing",
 			Action:    run,
 		},
+		{
+			Name:  "check",
+			Usage: "Validate project.lua and compile every Lua file",
+			Description: "Check command validates project.lua and compiles the Lua files of the project\n" +
+				"without running them or starting the server.",
+			Action: check,
+		},
+		{
+			Name:  "migrate",
+			Usage: "Apply or revert database migrations",
+			Description: "Migrate command manages the migrations in db.migrations.path, files named\n" +
+				"<version>_<name>.up.sql and <version>_<name>.down.sql, or .lua scripts that run\n" +
+				"with the transaction in the global tx. Applied versions are recorded in db.migrations.table.",
+			Commands: []*cli.Command{
+				{
+					Name:      "up",
+					Usage:     "Apply pending migrations, all of them unless n is given",
+					ArgsUsage: "[n]",
+					Action:    migrateUp,
+				},
+				{
+					Name:      "down",
+					Usage:     "Revert the last n applied migrations, 1 by default",
+					ArgsUsage: "[n]",
+					Action:    migrateDown,
+				},
+				{
+					Name:   "status",
+					Usage:  "List migrations and when they were applied",
+					Action: migrateStatus,
+				},
+				{
+					Name:      "create",
+					Usage:     "Create empty up and down files for a new migration",
+					ArgsUsage: "<name>",
+					Flags: []cli.Flag{
+						&cli.BoolFlag{
+							Name:  "lua",
+							Usage: "create Lua scripts instead of SQL files",
+						},
+					},
+					Action: migrateCreate,
+				},
+			},
+		},
+		{
+			Name:   "reload",
+			Usage:  "Reload the running server",
+			Action: reload,
+		},
+		{
+			Name:   "stop",
+			Usage:  "Stop the running server",
+			Action: stop,
+		},
+		{
+			Name:   "status",
+			Usage:  "Show the status of the running server",
+			Action: status,
+		},
 	}
 
 	if err := app.Run(context.Background(), os.Args); err != nil {
 		color.Red("%v", err)
+		os.Exit(1)
 	}
 }
 
@@ -144,18 +232,35 @@ func start(ctx context.Context, cmd *cli.Command) error {
 		startInteractive(ctx, cmd)
 		return nil
 	}
-	cfg, err := config.Parse(cmd.String("proj"))
+	cfg, err := config.Parse(cmd.String("proj"), cmd.String("profile"))
 	if err != nil {
 		return err
 	}
+	if err := cfg.Check(); err != nil {
+		return err
+	}
 	for k, v := range cfg.Env {
 		globalEnv[k] = v
 	}
 
-	if cfg.Pid == "" {
-		cfg.Pid = path.Join(os.TempDir(), DefaultPidFile)
+	runtimeDefaults(&cfg)
+	inWorker := daemon.IsChild() || runtime.GOOS == "windows"
+	if cfg.DB.Migrations.Auto {
+		switch memory := ledb.InMemory(cfg.DB); {
+		case memory && inWorker:
+			// every worker has its own in-memory database
+			err = autoMigrate(ctx, cfg)
+		case !memory && !daemon.IsChild():
+			// once before any worker starts, without keeping the pool
+			if err = autoMigrate(ctx, cfg); err == nil {
+				err = ledb.Close(cfg.DB)
+			}
+		}
+		if err != nil {
+			return err
+		}
 	}
-	if daemon.IsChild() || runtime.GOOS == "windows" {
+	if inWorker {
 		return worker(cmd, cfg)
 	}
 
@@ -164,62 +269,142 @@ func start(ctx context.Context, cmd *cli.Command) error {
 	}
 	defer os.Remove(cfg.Pid)
 
-	ln, err := net.Listen("tcp", cfg.Listen)
+	lns, err := listener.Open(cfg.Listeners)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		// also removes unix sockets
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}()
 
-	var proc, newproc *os.Process
-	proc, err = daemon.Fork(wd, ln.(*net.TCPListener))
-	if err != nil {
+	sup := &daemon.Supervisor{
+		Dir:          wd,
+		Listeners:    lns,
+		Workers:      cfg.Workers,
+		Drain:        time.Duration(cfg.Drain) * time.Second,
+		ReadyTimeout: time.Duration(cfg.ReadyTimeout) * time.Second,
+		Policy: daemon.Policy{
+			MinBackoff:  seconds(cfg.Restart.MinBackoff),
+			MaxBackoff:  seconds(cfg.Restart.MaxBackoff),
+			MaxRestarts: cfg.Restart.MaxRestarts,
+			Window:      seconds(cfg.Restart.Window),
+			CrashLog:    cfg.Restart.Log,
+			OnCrash:     onCrash(cmd, cfg),
+		},
+		Control: cfg.Control,
+		Logf:    warn,
+	}
+	if err := sup.Start(); err != nil {
 		return err
 	}
-	if proc == nil {
-		warn("warn: running in worker mode\n")
-		return worker(cmd, cfg)
+	ctl, err := daemon.Serve(cfg.Control, map[string]daemon.ControlHandler{
+		"status": func() (any, error) {
+			return sup.Status(), nil
+		},
+		"reload": func() (any, error) {
+			return nil, sup.Reload()
+		},
+		"stop": func() (any, error) {
+			go sup.Stop()
+			return nil, nil
+		},
+	})
+	if err != nil {
+		sup.Stop()
+		return err
 	}
+	defer ctl.Close()
 	handler := func(sig os.Signal) {
 		switch sig {
 		case syscall.SIGHUP:
-			if err := proc.Kill(); err != nil {
-				fail("%v\n", err)
-			}
-			if newproc, err = daemon.Fork(wd, ln.(*net.TCPListener)); err != nil {
-				fail("%v\n", err)
-			}
-		case syscall.SIGTERM:
-			if err = proc.Kill(); err != nil {
-				fail("%v\n", err)
+			if err := sup.Reload(); err != nil {
+				fail("reload: %v, rolling back\n", err)
 			}
+		case syscall.SIGTERM, os.Interrupt:
+			sup.Stop()
 		}
 	}
-	sigln := daemon.Listen(handler, syscall.SIGHUP, syscall.SIGTERM)
+	sigln := daemon.Listen(handler, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
 	defer sigln.Close()
 
-	if _, err := proc.Wait(); err != nil {
+	return sup.Wait()
+}
+
+// autoMigrate applies the pending migrations of the database.
+func autoMigrate(ctx context.Context, cfg config.Config) error {
+	migs, err := ledb.NewMigrator(cfg.DB, globalEnv).Up(ctx, 0)
+	if err != nil {
 		return err
 	}
-	for proc != newproc {
-		proc = newproc
-		if proc == nil {
-			return nil
-		}
-		_, err := proc.Wait()
-		if err != nil {
-			return err
+	for _, mig := range migs {
+		info("migrated: %s_%s\n", mig.Version, mig.Name)
+	}
+	return nil
+}
+
+// onCrash runs the crash script with the crash record in the global crash.
+func onCrash(cmd *cli.Command, cfg config.Config) func(daemon.Crash) {
+	if cfg.Restart.OnCrash == "" {
+		return nil
+	}
+	return func(c daemon.Crash) {
+		G := lue.New(globalEnv)
+		defer G.Close()
+		G.Register("crash", func(E *lue.Engine) lua.LValue {
+			t := E.NewTable()
+			E.SetFields(t, map[string]lua.LValue{
+				"pid":      lua.LNumber(c.Pid),
+				"status":   lua.LString(c.Status),
+				"code":     lua.LNumber(c.Code),
+				"uptime":   lua.LNumber(c.Uptime.Seconds()),
+				"time":     lua.LNumber(c.Time.Unix()),
+				"restarts": lua.LNumber(c.Restarts),
+			})
+			return t
+		}).
+			Register("cli", lecli.New(cmd.Args().Slice(), colors)).
+			Run(cfg.Restart.OnCrash)
+		if err := G.Err(); err != nil {
+			fail("on crash: %v\n", err)
 		}
 	}
+}
 
-	return nil
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
 }
 
 func worker(cmd *cli.Command, cfg config.Config) error {
 	sigln := daemon.Listen(daemon.ExitHandler, os.Interrupt)
 
-	ln, err := daemon.Forked(cfg.Listen)
+	lns, err := daemon.Forked(func() ([]net.Listener, error) {
+		return listener.Open(cfg.Listeners)
+	})
+	if err != nil {
+		return err
+	}
+
+	log, err := logging.New(cfg.Log)
 	if err != nil {
 		return err
 	}
+	defer log.Close()
+
+	if cfg.Trace.Enabled {
+		tracer, err := trace.New(cfg.Trace, func(err error) {
+			log.Warn("trace export failed", "error", err)
+		})
+		if err != nil {
+			return err
+		}
+		defer tracer.Close()
+		trace.Default = tracer
+		odbc.AddHook(trace.ObserveDB)
+		lhttp.Use(trace.HTTPClient)
+	}
 
 	var capp leapp.Config
 
@@ -227,35 +412,80 @@ func worker(cmd *cli.Command, cfg config.Config) error {
 		New(fiber.Config{
 			ServerHeader:          servername,
 			DisableStartupMessage: true,
+			BodyLimit:             cfg.Middleware.BodyLimit,
 		})
 	capp.App = app
+	if cfg.Health.Enabled {
+		// probes skip every middleware
+		capp.Health = health.New(time.Duration(cfg.Health.Timeout) * time.Second)
+		capp.Health.Add("db", ledb.Ping(cfg.DB))
+		for name, db := range cfg.Databases {
+			capp.Health.Add("db."+name, ledb.Ping(db))
+		}
+		app.Get(cfg.Health.Live, capp.Health.LiveHandler())
+		app.Get(cfg.Health.Ready, capp.Health.ReadyHandler())
+	}
 	app.
 		Use(timer.Print("total", "Total Time")).
-		Use(favicon.New()).
-		Use(requestid.New()).
-		Use(logger.New(logger.Config{
-			Done: func(c *fiber.Ctx, logString []byte) {
-				if tb := c.Locals("stacktrace"); tb != nil {
+		Use(timer.Marks())
+	odbc.AddHook(leapp.TimeDB)
+	if cfg.Log.SlowQuery > 0 {
+		odbc.AddHook(log.SlowQueries(time.Duration(cfg.Log.SlowQuery * float64(time.Second))))
+	}
+	lhttp.Use(leapp.TimeHTTP)
+	if cfg.Trace.Enabled {
+		app.Use(trace.Middleware())
+	}
+	if cfg.Metrics.Enabled {
+		app.Use(metrics.Middleware())
+		odbc.AddHook(metrics.ObserveDB)
+	}
+	app.
+		Use(func(c *fiber.Ctx) error {
+			err := c.Next()
+			if tb := c.Locals("stacktrace"); tb != nil {
+				if log.Format == config.LogText {
 					color.Red("%s", tb)
+				} else {
+					log.Request(c).Error("handler failed", "stacktrace", tb)
 				}
-			},
-		})).
-		Use(cors.New()).
-		Use(compress.New()).
-		Use(pprof.New()).
-		Use(func(c *fiber.Ctx) error {
-			// set before next to allow modifying
-			c.Set("Server", servername)
-			return c.Next()
+			}
+			return err
 		})
+	G := lue.New(globalEnv)
+	defer G.Close()
 
-	apigrp := app.Group(cfg.ApiBase)
-	if l := cfg.Limiter; l.Enabled {
-		apigrp.Use(limiter.New(limiter.Config{
-			Max:        l.Max,
-			Expiration: time.Duration(l.Dur) * time.Second,
-		}))
+	// created before the middleware that is guarded by it
+	var api *admin.API
+	var adminAuth func(*fiber.Ctx) bool
+	if cfg.Admin.Enabled {
+		hooks := admin.Hooks{
+			Stats: func() any {
+				return adminStats(cfg, app, G)
+			},
+			DB: func() (*sql.DB, error) {
+				return ledb.DB(cfg.DB)
+			},
+		}
+		if daemon.IsChild() {
+			// capp.Reload is set below
+			hooks.Reload = func() error { return capp.Reload() }
+		}
+		if api, err = admin.New(cfg, log, hooks); err != nil {
+			return err
+		}
+		adminAuth = api.Authorized
 	}
+	if err := middleware.Use(app, cfg.Middleware, cfg.ApiBase, log, adminAuth); err != nil {
+		return err
+	}
+	app.Use(func(c *fiber.Ctx) error {
+		// set before next to allow modifying
+		c.Set("Server", servername)
+		return c.Next()
+	})
+
+	apigrp := app.Group(cfg.ApiBase)
 	apigrp.
 		Use(recover.New(recover.Config{
 			EnableStackTrace: true,
@@ -263,16 +493,29 @@ func worker(cmd *cli.Command, cfg config.Config) error {
 		Use(timer.Print("exec", "Script Execution"))
 
 	admingrp := apigrp.Group(cfg.AdminBase)
-	if cfg.Editing {
-		admingrp.All("/files/*", admin.Files(cfg.Index))
-		warn("warn: editing allowed\n")
+	if cfg.Metrics.Enabled {
+		if cfg.Metrics.Public {
+			admingrp.Get(cfg.Metrics.Path, metrics.Handler())
+		} else {
+			admingrp.Get(cfg.Metrics.Path, api.Auth, metrics.Handler())
+		}
+	}
+	if api != nil {
+		api.Mount(admingrp)
+		if cfg.Admin.Console {
+			app.Use(api.Record(path.Join(cfg.ApiBase, cfg.AdminBase)))
+		}
 	}
 
 	var storage fiber.Storage
 	if cfg.DataPath != "" {
-		storage = sbolt.New(sbolt.Config{
-			Database: path.Join(cfg.DataPath, "fiber.db"),
-		})
+		// shared by the workers and the one taking over on reload
+		s, err := store.New(path.Join(cfg.DataPath, "sessions.db"))
+		if err != nil {
+			return errors.Wrap(err, "session store")
+		}
+		defer s.Close()
+		storage = s
 	}
 	capp.Store = session.New(session.Config{
 		Storage: storage,
@@ -307,12 +550,25 @@ func worker(cmd *cli.Command, cfg config.Config) error {
 			})
 	}
 
+	srv := &listener.Server{
+		App:       app,
+		Listeners: cfg.Listeners,
+		OnError: func(err error) {
+			panic(errors.Wrap(err, "http start"))
+		},
+	}
+	if cfg.Admin.ClientCA != "" {
+		srv.ClientCAs, err = listener.LoadClientCAs(cfg.Admin.ClientCA)
+		if err != nil {
+			return err
+		}
+	}
+	started := false
 	capp.Start = func(_ string) error {
-		go func() {
-			if err := app.Listener(ln); err != nil {
-				panic(errors.Wrap(err, "http start"))
-			}
-		}()
+		if err := srv.Serve(lns); err != nil {
+			return err
+		}
+		started = true
 		return nil
 	}
 
@@ -324,12 +580,8 @@ func worker(cmd *cli.Command, cfg config.Config) error {
 		capp.Reload = func() error {
 			fmt.Println("reloading...")
 
-			if err := daemon.Kill(pid, syscall.SIGHUP); err != nil {
-				return err
-			}
-
-			os.Exit(0)
-			return nil
+			// the parent stops this worker once its replacement is ready
+			return daemon.Kill(pid, syscall.SIGHUP)
 		}
 	}
 
@@ -340,6 +592,12 @@ func worker(cmd *cli.Command, cfg config.Config) error {
 		sig := daemon.Listen(daemon.ExitHandler, os.Interrupt)
 		defer sig.Close()
 
+		if capp.Health != nil {
+			// let load balancers stop sending requests first
+			capp.Health.SetReady(false)
+			time.Sleep(time.Duration(cfg.Health.ShutdownDelay) * time.Second)
+		}
+
 		var err error
 		if timeout != 0 {
 			err = app.ShutdownWithTimeout(timeout)
@@ -350,33 +608,366 @@ func worker(cmd *cli.Command, cfg config.Config) error {
 			return err
 		}
 
-		return nil
+		return srv.Shutdown()
 	}
 
-	G := lue.New(globalEnv)
-	defer G.Close()
 	G.Register("app", leapp.New(capp)).
-		Register("db", ledb.New(cfg.DB)).
+		Register("db", ledb.New(cfg.DB, cfg.Databases)).
+		Register("log", lelog.New(log)).
+		Register("metrics", lemetrics.New()).
 		Register("cli", lecli.New(cmd.Args().Slice(), colors)).
 		Run(cfg.Index)
 
 	if err := G.Err(); err != nil {
 		return err
 	}
+	if capp.Health != nil && started {
+		capp.Health.SetReady(true)
+	}
+	metrics.LuaStates.Collect = func(m *metrics.Metric) {
+		stats := G.PoolStats()
+		m.Set(float64(stats.Idle), "idle")
+		m.Set(float64(stats.Busy), "busy")
+	}
+
+	if daemon.IsChild() {
+		sock := daemon.WorkerSocket(cfg.Control, os.Getpid())
+		ctl, err := daemon.Serve(sock, map[string]daemon.ControlHandler{
+			"stats": func() (any, error) {
+				return workerStats{
+					Project:     cfg.Version,
+					Connections: app.Server().GetOpenConnectionsCount(),
+					Pool:        G.PoolStats(),
+				}, nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+		defer ctl.Close()
+	}
+	if err := daemon.Ready(); err != nil {
+		return err
+	}
 
 	sigln.Close()
 	if cmd.Bool("interactive") {
 		interactive(G)
 	} else {
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, syscall.SIGQUIT)
+		signal.Notify(c, os.Interrupt, syscall.SIGQUIT, syscall.SIGTERM)
 		<-c
-		G.Eval(`app:stop(10)`)
+		G.Eval(fmt.Sprintf(`app:stop(%d)`, cfg.Drain))
 	}
 
 	return nil
 }
 
+func check(ctx context.Context, cmd *cli.Command) error {
+	ok, err := config.IsProject(cmd.String("proj"))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New(config.ProjectFileName + " not found")
+	}
+	cfg, err := config.Parse(cmd.String("proj"), cmd.String("profile"))
+	if err != nil {
+		return err
+	}
+	failed := false
+	if err := cfg.Check(); err != nil {
+		fail("%v\n", err)
+		failed = true
+	}
+
+	files := make(map[string]bool)
+	if ok, _ := dir.Is(cfg.Index); ok {
+		err := filepath.WalkDir(cfg.Index, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && p != cfg.Index && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if !d.IsDir() && filepath.Ext(p) == ".lua" {
+				files[filepath.Clean(p)] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		files[filepath.Clean(cfg.Index)] = true
+	}
+	for _, p := range cfg.Commands {
+		files[filepath.Clean(p)] = true
+	}
+	if cfg.Restart.OnCrash != "" {
+		files[filepath.Clean(cfg.Restart.OnCrash)] = true
+	}
+
+	n := 0
+	for p := range files {
+		if _, err := os.Stat(p); err != nil {
+			continue // reported by cfg.Check
+		}
+		if _, err := lut.ParseLua(p); err != nil {
+			fail("%v\n", err)
+			failed = true
+			continue
+		}
+		n++
+	}
+	if failed {
+		return errors.New("check failed")
+	}
+	succ("ok")
+	print(": %s is valid, %d Lua files compiled\n", config.ProjectFileName, n)
+	return nil
+}
+
+// workerStats is reported by a worker on its stats socket.
+type workerStats struct {
+	Project     string        `json:"project"`
+	Connections int32         `json:"connections"`
+	Pool        lutpool.Stats `json:"pool"`
+}
+
+// adminStats is shown by the admin console.
+func adminStats(cfg config.Config, app *fiber.App, G *lue.Engine) any {
+	stats := map[string]any{
+		"worker": workerStats{
+			Project:     cfg.Version,
+			Connections: app.Server().GetOpenConnectionsCount(),
+			Pool:        G.PoolStats(),
+		},
+		"pid": os.Getpid(),
+	}
+	if db, err := ledb.DB(cfg.DB); err == nil {
+		stats["db"] = db.Stats()
+	}
+	databases := make(map[string]sql.DBStats)
+	for name, c := range cfg.Databases {
+		if db, err := ledb.DB(c); err == nil {
+			databases[name] = db.Stats()
+		}
+	}
+	if len(databases) > 0 {
+		stats["databases"] = databases
+	}
+	return stats
+}
+
+// runtimeDefaults fills in the paths left empty in the manifest.
+func runtimeDefaults(cfg *config.Config) {
+	if cfg.Pid == "" {
+		cfg.Pid = path.Join(os.TempDir(), DefaultPidFile)
+	}
+	if cfg.Control == "" {
+		// one per project, so that commands reach the server of their
+		// own project; the manifest has made it the working directory
+		wd, _ := os.Getwd()
+		sum := sha256.Sum256([]byte(wd))
+		cfg.Control = path.Join(os.TempDir(), fmt.Sprintf(DefaultControlFile, sum[:6]))
+	}
+}
+
+// controlPath finds the control socket of the project.
+func controlPath(cmd *cli.Command) (string, error) {
+	var cfg config.Config
+	ok, err := config.IsProject(cmd.String("proj"))
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		if cfg, err = config.Parse(cmd.String("proj"), cmd.String("profile")); err != nil {
+			return "", err
+		}
+	}
+	runtimeDefaults(&cfg)
+	return cfg.Control, nil
+}
+
+func reload(ctx context.Context, cmd *cli.Command) error {
+	ctl, err := controlPath(cmd)
+	if err != nil {
+		return err
+	}
+	if err := daemon.Call(ctl, "reload", nil); err != nil {
+		return err
+	}
+	succ("reloaded\n")
+	return nil
+}
+
+func stop(ctx context.Context, cmd *cli.Command) error {
+	ctl, err := controlPath(cmd)
+	if err != nil {
+		return err
+	}
+	if err := daemon.Call(ctl, "stop", nil); err != nil {
+		return err
+	}
+	succ("stopping\n")
+	return nil
+}
+
+func status(ctx context.Context, cmd *cli.Command) error {
+	ctl, err := controlPath(cmd)
+	if err != nil {
+		return err
+	}
+	var st daemon.Status
+	if err := daemon.Call(ctl, "status", &st); err != nil {
+		return err
+	}
+	succ("running")
+	print(" pid %d, up %v, %d workers\n", st.Pid, uptime(st.Uptime), len(st.Workers))
+	for _, w := range st.Workers {
+		info("worker %d", w.Pid)
+		print(" up %v", uptime(w.Uptime))
+		if w.Error != "" {
+			fail(" %s\n", w.Error)
+			continue
+		}
+		var ws workerStats
+		if err := json.Unmarshal(w.Stats, &ws); err != nil {
+			fail(" %v\n", err)
+			continue
+		}
+		print(", project %q, %d connections, lua states %d busy / %d idle\n",
+			ws.Project, ws.Connections, ws.Pool.Busy, ws.Pool.Idle)
+	}
+	return nil
+}
+
+func uptime(s float64) time.Duration {
+	return seconds(s).Round(time.Second)
+}
+
+// migrator returns the migrator of the database of the project.
+func migrator(cmd *cli.Command) (*ledb.Migrator, config.Config, error) {
+	var cfg config.Config
+	ok, err := config.IsProject(cmd.String("proj"))
+	if err != nil {
+		return nil, cfg, err
+	}
+	if !ok {
+		return nil, cfg, errors.New(config.ProjectFileName + " not found")
+	}
+	if cfg, err = config.Parse(cmd.String("proj"), cmd.String("profile")); err != nil {
+		return nil, cfg, err
+	}
+	for k, v := range cfg.Env {
+		globalEnv[k] = v
+	}
+	return ledb.NewMigrator(cfg.DB, globalEnv), cfg, nil
+}
+
+// migrateCount returns the optional count argument.
+func migrateCount(cmd *cli.Command, def int) (int, error) {
+	if !cmd.Args().Present() {
+		return def, nil
+	}
+	n, err := strconv.Atoi(cmd.Args().First())
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("expected a positive count, got %q", cmd.Args().First())
+	}
+	return n, nil
+}
+
+func migrateUp(ctx context.Context, cmd *cli.Command) error {
+	m, _, err := migrator(cmd)
+	if err != nil {
+		return err
+	}
+	n, err := migrateCount(cmd, 0)
+	if err != nil {
+		return err
+	}
+	migs, err := m.Up(ctx, n)
+	if err != nil {
+		return err
+	}
+	for _, mig := range migs {
+		succ("up")
+		print(" %s_%s\n", mig.Version, mig.Name)
+	}
+	if len(migs) == 0 {
+		print("no pending migrations\n")
+	}
+	return nil
+}
+
+func migrateDown(ctx context.Context, cmd *cli.Command) error {
+	m, _, err := migrator(cmd)
+	if err != nil {
+		return err
+	}
+	n, err := migrateCount(cmd, 1)
+	if err != nil {
+		return err
+	}
+	migs, err := m.Down(ctx, n)
+	if err != nil {
+		return err
+	}
+	for _, mig := range migs {
+		warn("down")
+		print(" %s_%s\n", mig.Version, mig.Name)
+	}
+	if len(migs) == 0 {
+		print("no applied migrations\n")
+	}
+	return nil
+}
+
+func migrateStatus(ctx context.Context, cmd *cli.Command) error {
+	m, _, err := migrator(cmd)
+	if err != nil {
+		return err
+	}
+	migs, err := m.Status()
+	if err != nil {
+		return err
+	}
+	for _, mig := range migs {
+		switch {
+		case mig.Up == "":
+			fail("missing ")
+			print(" %s, applied %s\n", mig.Version, mig.Applied.Format(time.RFC3339))
+		case mig.Applied.IsZero():
+			warn("pending ")
+			print(" %s_%s\n", mig.Version, mig.Name)
+		default:
+			succ("applied ")
+			print(" %s_%s, %s\n", mig.Version, mig.Name, mig.Applied.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+func migrateCreate(ctx context.Context, cmd *cli.Command) error {
+	_, cfg, err := migrator(cmd)
+	if err != nil {
+		return err
+	}
+	if !cmd.Args().Present() {
+		return errors.New("migration name not specified")
+	}
+	files, err := ledb.CreateMigration(cfg.DB, strings.Join(cmd.Args().Slice(), "_"), cmd.Bool("lua"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		succ("created")
+		print(" %s\n", f)
+	}
+	return nil
+}
+
 func startInteractive(ctx context.Context, cmd *cli.Command) {
 	fmt.Printf("Mirai Server %s %s\n", version, build)
 	app := fiber.New()
@@ -407,7 +998,7 @@ func startInteractive(ctx context.Context, cmd *cli.Command) {
 	G := lue.New(globalEnv)
 	defer G.Close()
 	G.Register("app", leapp.New(capp)).
-		Register("db", ledb.New(db)).
+		Register("db", ledb.New(db, nil)).
 		Register("cli", lecli.New(cmd.Args().Slice(), colors))
 	if err := G.Err(); err != nil {
 		fail("%v\n", err)
@@ -426,28 +1017,42 @@ func run(ctx context.Context, cmd *cli.Command) error {
 		return err
 	}
 
-	G := lue.New(globalEnv)
-	defer G.Close()
-
-	path := ""
+	path := args.First()
+	var (
+		db        *config.DB
+		databases map[string]config.DB
+	)
+	logc := config.Log{Format: config.LogText, Level: "info"}
 	if ok {
-		cfg, err := config.Parse(cmd.String("proj"))
+		cfg, err := config.Parse(cmd.String("proj"), cmd.String("profile"))
 		if err != nil {
 			return err
 		}
 		for k, v := range cfg.Env {
 			globalEnv[k] = v
 		}
-		path, ok = cfg.Commands[args.First()]
-		if !ok {
-			path = args.First()
+		if p, ok := cfg.Commands[args.First()]; ok {
+			path = p
 		}
-		G.Register("db", ledb.New(cfg.DB))
+		db, databases = &cfg.DB, cfg.Databases
+		logc = cfg.Log
 	} else {
 		warn("warn: project manifest not found\n")
-		path = args.First()
 	}
-	G.Register("cli", lecli.New(args.Tail(), colors)).
+
+	// created after parsing so that env includes the project's
+	G := lue.New(globalEnv)
+	defer G.Close()
+	if db != nil {
+		G.Register("db", ledb.New(*db, databases))
+	}
+	log, err := logging.New(logc)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	G.Register("log", lelog.New(log)).
+		Register("cli", lecli.New(args.Tail(), colors)).
 		Run(path)
 	if err := G.Err(); err != nil {
 		fail("%v\n", err)
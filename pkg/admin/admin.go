@@ -1,59 +1,223 @@
+// Package admin serves the remote administration api: project files,
+// reloads, logs and the running configuration.
 package admin
 
 import (
-	"io/fs"
+	"bytes"
+	"crypto/subtle"
+	"database/sql"
+	"io"
 	"os"
-	"path"
-	"path/filepath"
+	"strconv"
 	"strings"
 
+	"github.com/cloudwindy/mirai/pkg/config"
+	"github.com/cloudwindy/mirai/pkg/logging"
 	"github.com/gofiber/fiber/v2"
 )
 
-func Files(base string) fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		file := c.Params("*")
-		if file == "" {
-			names := make([]string, 0)
-			err := filepath.WalkDir(base, func(path string, d fs.DirEntry, err error) error {
-				if !d.IsDir() {
-					path = strings.TrimPrefix(path, base+"/")
-					names = append(names, path)
-				}
-				return err
-			})
-			if err != nil {
-				return err
-			}
-			return c.JSON(names)
+// Lines returned by the logs endpoint by default and at most.
+const (
+	DefaultLogLines = 100
+	MaxLogLines     = 10000
+)
+
+// Hooks connect the api to the running worker. A nil hook disables its
+// endpoint.
+type Hooks struct {
+	// triggers a reload
+	Reload func() error
+	// worker statistics for the console
+	Stats func() any
+	// database of the db module for the console
+	DB func() (*sql.DB, error)
+}
+
+// API is the admin api of a project.
+type API struct {
+	c        config.Config
+	log      *logging.Logger
+	hooks    Hooks
+	files    *files
+	requests *recorder
+}
+
+// New creates the admin api of the project c.
+func New(c config.Config, log *logging.Logger, hooks Hooks) (*API, error) {
+	f, err := newFiles(c.Admin.Root, c.Admin.Backups)
+	if err != nil {
+		return nil, err
+	}
+	return &API{
+		c:        c,
+		log:      log,
+		hooks:    hooks,
+		files:    f,
+		requests: newRecorder(RecentRequests),
+	}, nil
+}
+
+// Mount adds the routes of the api to r, every one behind authentication.
+func (a *API) Mount(r fiber.Router) {
+	r.Get("/files", a.auth, a.list)
+	r.Get("/files/*", a.auth, a.get)
+	r.Put("/files/*", a.auth, a.put)
+	r.Delete("/files/*", a.auth, a.delete)
+	r.Post("/reload", a.auth, a.postReload)
+	r.Get("/logs", a.auth, a.logs)
+	r.Get("/config", a.auth, a.config)
+	if a.c.Admin.Console {
+		a.mountConsole(r)
+	}
+}
+
+// Auth is the handler guarding the admin routes, see auth.
+func (a *API) Auth(c *fiber.Ctx) error {
+	return a.auth(c)
+}
+
+// auth accepts a bearer token, the cookie set by the console login or a
+// verified client certificate. The identity is stored in Locals("admin")
+// for the audit log.
+func (a *API) auth(c *fiber.Ctx) error {
+	if who, ok := a.authorized(c); ok {
+		c.Locals("admin", who)
+		return c.Next()
+	}
+	c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="mirai admin"`)
+	return fiber.ErrUnauthorized
+}
+
+// Authorized reports whether c is authorized as an admin, e.g. to guard
+// admin routes mounted elsewhere.
+func (a *API) Authorized(c *fiber.Ctx) bool {
+	_, ok := a.authorized(c)
+	return ok
+}
+
+func (a *API) authorized(c *fiber.Ctx) (who string, ok bool) {
+	if state := c.Context().TLSConnectionState(); state != nil && len(state.VerifiedChains) > 0 {
+		return "cert:" + state.VerifiedChains[0][0].Subject.CommonName, true
+	}
+	if token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "); ok {
+		return a.token(token)
+	}
+	if a.c.Admin.Console {
+		if token := c.Cookies(cookieName); token != "" {
+			return a.token(token)
 		}
-		file = path.Join(base, file)
-		switch c.Method() {
-		case "GET":
-			return c.SendFile(file)
-		case "PUT":
-			ensureDir(file)
-			if err := os.WriteFile(file, c.Body(), 0o644); err != nil {
-				return err
-			}
-			return c.SendString("ok")
-		case "DELETE":
-			if err := os.Remove(file); err != nil {
-				return err
-			}
-			return c.SendString("ok")
+	}
+	return "", false
+}
+
+// token checks token against the configured tokens.
+func (a *API) token(token string) (who string, ok bool) {
+	for i, t := range a.c.Admin.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return "token:" + strconv.Itoa(i+1), true
 		}
-		return nil
 	}
+	return "", false
 }
 
-// Create directories recursively
-func ensureDir(fileName string) {
-	dirName := filepath.Dir(fileName)
-	if _, serr := os.Stat(dirName); serr != nil {
-		merr := os.MkdirAll(dirName, os.ModePerm)
-		if merr != nil {
-			panic(merr)
+// audit logs a change made through the api.
+func (a *API) audit(c *fiber.Ctx, action string, args ...any) {
+	args = append([]any{"action", action, "admin", c.Locals("admin")}, args...)
+	a.log.Request(c).Info("admin", args...)
+}
+
+func (a *API) postReload(c *fiber.Ctx) error {
+	if a.hooks.Reload == nil {
+		return fiber.NewError(fiber.StatusNotImplemented, "reload is not supported by this worker")
+	}
+	a.audit(c, "reload")
+	if err := a.hooks.Reload(); err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusAccepted).SendString("reloading")
+}
+
+// logs sends the last lines of the log file, ?lines=n.
+func (a *API) logs(c *fiber.Ctx) error {
+	file := a.c.Log.File
+	if file == "" {
+		return fiber.NewError(fiber.StatusNotFound, "log.file is not set")
+	}
+	n := c.QueryInt("lines", DefaultLogLines)
+	if n < 1 || n > MaxLogLines {
+		return fiber.NewError(fiber.StatusBadRequest, "lines must be between 1 and "+strconv.Itoa(MaxLogLines))
+	}
+	tail, err := tailFile(file, n)
+	if err != nil {
+		return err
+	}
+	c.Type("txt", "utf-8")
+	return c.Send(tail)
+}
+
+// tailFile returns the last n lines of file, reading at most 1 MiB.
+func tailFile(file string, n int) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := max(0, info.Size()-1<<20)
+	b, err := io.ReadAll(io.NewSectionReader(f, offset, info.Size()-offset))
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] == '\n' {
+			if n--; n == 0 {
+				return b[i+1:], nil
+			}
 		}
 	}
+	return b, nil
+}
+
+// config sends the running configuration with secrets redacted.
+func (a *API) config(c *fiber.Ctx) error {
+	return c.JSON(redact(a.c))
+}
+
+const redacted = "[redacted]"
+
+func redact(c config.Config) config.Config {
+	tokens := make([]string, len(c.Admin.Tokens))
+	for i := range tokens {
+		tokens[i] = redacted
+	}
+	c.Admin.Tokens = tokens
+	c.DB = redactDB(c.DB)
+	databases := make(map[string]config.DB, len(c.Databases))
+	for name, db := range c.Databases {
+		databases[name] = redactDB(db)
+	}
+	c.Databases = databases
+	headers := make(map[string]string, len(c.Trace.Headers))
+	for k := range c.Trace.Headers {
+		headers[k] = redacted
+	}
+	c.Trace.Headers = headers
+	env := make(map[string]any, len(c.Env))
+	for k := range c.Env {
+		env[k] = redacted
+	}
+	c.Env = env
+	return c
+}
+
+func redactDB(db config.DB) config.DB {
+	if db.Driver != "sqlite3" && db.Conn != "" {
+		// connection strings of servers carry passwords
+		db.Conn = redacted
+	}
+	return db
 }
@@ -0,0 +1,322 @@
+package admin
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// pages of the console, scripts and styles are inlined
+//
+//go:embed console
+var consoleFS embed.FS
+
+// Console limits.
+var (
+	// requests kept for the live request log
+	RecentRequests = 500
+	// rows returned by a console query
+	MaxSQLRows = 1000
+	// time allowed for a console query
+	SQLTimeout = 10 * time.Second
+)
+
+// cookie holding the token after a console login
+const cookieName = "mirai_admin"
+
+func (a *API) mountConsole(r fiber.Router) {
+	r.Get("/console", a.console)
+	r.Post("/console/login", a.login)
+	r.Post("/console/logout", a.logout)
+	r.Get("/requests", a.auth, a.recent)
+	r.Get("/routes", a.auth, a.routes)
+	r.Get("/stats", a.auth, a.stats)
+	r.Post("/sql", a.auth, a.sql)
+}
+
+// console sends the console, or the login page to visitors that are not
+// authenticated.
+func (a *API) console(c *fiber.Ctx) error {
+	page := "console/index.html"
+	if _, ok := a.authorized(c); !ok {
+		page = "console/login.html"
+	}
+	b, err := consoleFS.ReadFile(page)
+	if err != nil {
+		return err
+	}
+	c.Set("Cache-Control", "no-store")
+	c.Type("html", "utf-8")
+	return c.Send(b)
+}
+
+// login checks the token of the login form and keeps it in a cookie
+// scoped to the admin group.
+func (a *API) login(c *fiber.Ctx) error {
+	token := c.FormValue("token")
+	who, ok := a.token(token)
+	if !ok {
+		return c.Redirect("../console?failed", fiber.StatusSeeOther)
+	}
+	c.Locals("admin", who)
+	a.audit(c, "login")
+	c.Cookie(&fiber.Cookie{
+		Name:     cookieName,
+		Value:    token,
+		Path:     adminPath(c.Path(), "/console/login"),
+		Secure:   c.Protocol() == "https",
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteStrictMode,
+	})
+	return c.Redirect("../console", fiber.StatusSeeOther)
+}
+
+func (a *API) logout(c *fiber.Ctx) error {
+	c.Cookie(&fiber.Cookie{
+		Name:     cookieName,
+		Path:     adminPath(c.Path(), "/console/logout"),
+		Expires:  time.Unix(0, 0),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteStrictMode,
+	})
+	return c.Redirect("../console", fiber.StatusSeeOther)
+}
+
+// adminPath returns the path of the admin group from the path p of the
+// route suffix.
+func adminPath(p, suffix string) string {
+	return strings.TrimSuffix(p, suffix)
+}
+
+// Request is a record of the live request log.
+type Request struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	LatencyMS float64   `json:"latency_ms"`
+	IP        string    `json:"ip"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// recorder keeps the most recent requests.
+type recorder struct {
+	mu   sync.Mutex
+	seq  uint64
+	ring []Request
+	next int
+}
+
+func newRecorder(n int) *recorder {
+	return &recorder{ring: make([]Request, 0, n)}
+}
+
+func (r *recorder) add(req Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	req.Seq = r.seq
+	if len(r.ring) < cap(r.ring) {
+		r.ring = append(r.ring, req)
+		return
+	}
+	r.ring[r.next] = req
+	r.next = (r.next + 1) % len(r.ring)
+}
+
+// since returns the requests after seq, oldest first.
+func (r *recorder) since(seq uint64) []Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reqs := make([]Request, 0)
+	for i := range r.ring {
+		req := r.ring[(r.next+i)%len(r.ring)]
+		if req.Seq > seq {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs
+}
+
+// Record adds every request outside of the admin group to the live request
+// log of the console.
+func (a *API) Record(adminBase string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if strings.HasPrefix(c.Path(), adminBase) {
+			return c.Next()
+		}
+		start := time.Now()
+		err := c.Next()
+		status := c.Response().StatusCode()
+		if ferr, ok := err.(*fiber.Error); ok {
+			status = ferr.Code
+		} else if err != nil {
+			status = fiber.StatusInternalServerError
+		}
+		id, _ := c.Locals("requestid").(string)
+		// strings of the request are only valid until it ends
+		a.requests.add(Request{
+			Time:      start,
+			Method:    strings.Clone(c.Method()),
+			Path:      strings.Clone(c.OriginalURL()),
+			Status:    status,
+			LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			IP:        c.IP(),
+			RequestID: id,
+		})
+		return err
+	}
+}
+
+// recent sends the requests after ?after=seq.
+func (a *API) recent(c *fiber.Ctx) error {
+	return c.JSON(a.requests.since(uint64(c.QueryInt("after"))))
+}
+
+// Route is an entry of the route table.
+type Route struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Name   string `json:"name,omitempty"`
+}
+
+func (a *API) routes(c *fiber.Ctx) error {
+	var routes []Route
+	for _, r := range c.App().GetRoutes(true) {
+		if r.Method == fiber.MethodHead {
+			// added with every get
+			continue
+		}
+		routes = append(routes, Route{Method: r.Method, Path: r.Path, Name: r.Name})
+	}
+	return c.JSON(routes)
+}
+
+func (a *API) stats(c *fiber.Ctx) error {
+	if a.hooks.Stats == nil {
+		return fiber.ErrNotImplemented
+	}
+	return c.JSON(a.hooks.Stats())
+}
+
+// Result is the result of a console query.
+type Result struct {
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+	// more rows were left out
+	Truncated bool `json:"truncated"`
+}
+
+// sql runs a read-only query against the database of the db module.
+func (a *API) sql(c *fiber.Ctx) error {
+	if a.hooks.DB == nil {
+		return fiber.ErrNotImplemented
+	}
+	var req struct {
+		Query string `json:"query"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	query, err := readOnly(req.Query)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	db, err := a.hooks.DB()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(c.UserContext(), SQLTimeout)
+	defer cancel()
+	a.audit(c, "sql", "query", query)
+	res, err := queryReadOnly(ctx, db, a.c.DB.Driver, query)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return c.JSON(res)
+}
+
+// readOnly trims query and accepts a single select, with, explain or
+// values statement.
+func readOnly(query string) (string, error) {
+	query = strings.TrimSpace(query)
+	query = strings.TrimSpace(strings.TrimSuffix(query, ";"))
+	if query == "" {
+		return "", errEmptyQuery
+	}
+	if strings.Contains(query, ";") {
+		return "", errMultipleStatements
+	}
+	switch strings.ToLower(strings.Fields(query)[0]) {
+	case "select", "with", "explain", "values":
+		return query, nil
+	}
+	return "", errNotReadOnly
+}
+
+var (
+	errEmptyQuery         = errors.New("empty query")
+	errMultipleStatements = errors.New("only a single statement is allowed")
+	errNotReadOnly        = errors.New("only select, with, explain and values statements are allowed")
+)
+
+// queryReadOnly runs query in a transaction that is rolled back. Servers
+// get a read-only transaction, sqlite the query_only pragma.
+func queryReadOnly(ctx context.Context, db *sql.DB, driver, query string) (*Result, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	sqlite := driver == "sqlite3"
+	if sqlite {
+		if _, err := conn.ExecContext(ctx, "PRAGMA query_only = ON"); err != nil {
+			return nil, err
+		}
+		// the connection goes back to the pool
+		defer conn.ExecContext(context.Background(), "PRAGMA query_only = OFF")
+	}
+	tx, err := conn.BeginTx(ctx, &sql.TxOptions{ReadOnly: !sqlite})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Columns: columns, Rows: make([][]any, 0)}
+	for rows.Next() {
+		if len(res.Rows) == MaxSQLRows {
+			res.Truncated = true
+			break
+		}
+		row := make([]any, len(columns))
+		ptrs := make([]any, len(columns))
+		for i := range row {
+			ptrs[i] = &row[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		for i, v := range row {
+			if b, ok := v.([]byte); ok {
+				row[i] = string(b)
+			}
+		}
+		res.Rows = append(res.Rows, row)
+	}
+	return res, rows.Err()
+}
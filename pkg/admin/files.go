@@ -0,0 +1,329 @@
+package admin
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudwindy/mirai/pkg/lut"
+	"github.com/gofiber/fiber/v2"
+)
+
+// BackupDir is the directory under the root holding previous versions of
+// files. It is hidden from the api.
+const BackupDir = ".backups"
+
+const backupTime = "20060102T150405.000000000"
+
+// files manages the files under a root directory.
+type files struct {
+	root string
+	// root with symlinks resolved
+	real string
+	// backups kept per file, negative for none
+	backups int
+	// serializes changes
+	mu sync.Mutex
+}
+
+func newFiles(root string, backups int) (*files, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	return &files{root: root, real: real, backups: backups}, nil
+}
+
+// Entry describes a file in a listing.
+type Entry struct {
+	Path     string    `json:"path"`
+	Dir      bool      `json:"dir"`
+	Size     int64     `json:"size"`
+	Mode     string    `json:"mode"`
+	Modified time.Time `json:"modified"`
+}
+
+var errOutside = fiber.NewError(fiber.StatusForbidden, "path is outside of the admin root")
+
+// resolve returns the file for the path rel of a request. The file must be
+// under the root after resolving symlinks and must not be a backup.
+func (f *files) resolve(rel string) (string, error) {
+	rel, err := url.PathUnescape(rel)
+	if err != nil {
+		return "", fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	rel = strings.TrimPrefix(path.Clean("/"+rel), "/")
+	if rel == BackupDir || strings.HasPrefix(rel, BackupDir+"/") {
+		return "", errOutside
+	}
+	p := filepath.Join(f.root, filepath.FromSlash(rel))
+	real, err := evalExisting(p)
+	if err != nil {
+		return "", err
+	}
+	if real != f.real && !strings.HasPrefix(real, f.real+string(filepath.Separator)) {
+		return "", errOutside
+	}
+	return p, nil
+}
+
+// evalExisting resolves the symlinks of the longest existing prefix of p.
+func evalExisting(p string) (string, error) {
+	var rest []string
+	for {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(append([]string{real}, rest...)...), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+		p = parent
+	}
+}
+
+// rel returns the api path of the file p.
+func (f *files) rel(p string) string {
+	rel, _ := filepath.Rel(f.root, p)
+	return filepath.ToSlash(rel)
+}
+
+// list walks dir, skipping the backups.
+func (f *files) list(dir string) ([]Entry, error) {
+	entries := make([]Entry, 0)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		if d.IsDir() && p == filepath.Join(f.root, BackupDir) {
+			return filepath.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, Entry{
+			Path:     f.rel(p),
+			Dir:      d.IsDir(),
+			Size:     info.Size(),
+			Mode:     info.Mode().String(),
+			Modified: info.ModTime(),
+		})
+		return nil
+	})
+	return entries, err
+}
+
+// write replaces the file p with data atomically, backing up the previous
+// version. It reports whether the file was created.
+func (f *files) write(p string, data []byte) (created bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	mode := os.FileMode(0o644)
+	info, err := os.Stat(p)
+	switch {
+	case err == nil && info.IsDir():
+		return false, fiber.NewError(fiber.StatusConflict, "path is a directory")
+	case err == nil:
+		mode = info.Mode().Perm()
+		if err := f.backup(p, false); err != nil {
+			return false, err
+		}
+	case errors.Is(err, os.ErrNotExist):
+		created = true
+	default:
+		return false, err
+	}
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return false, err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return false, err
+	}
+	return created, os.Rename(tmp.Name(), p)
+}
+
+// remove deletes the file p, moving it to the backups.
+func (f *files) remove(p string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fiber.NewError(fiber.StatusConflict, "path is a directory")
+	}
+	if f.backups < 0 {
+		return os.Remove(p)
+	}
+	return f.backup(p, true)
+}
+
+// backup saves the current version of p, moving it if move is set, and
+// drops the oldest backups of p.
+func (f *files) backup(p string, move bool) error {
+	if f.backups < 0 {
+		return nil
+	}
+	rel := filepath.FromSlash(f.rel(p))
+	dir := filepath.Join(f.root, BackupDir, filepath.Dir(rel))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	name := filepath.Base(rel) + "."
+	dst := filepath.Join(dir, name+time.Now().UTC().Format(backupTime))
+	var err error
+	if move {
+		err = os.Rename(p, dst)
+	} else {
+		err = copyFile(p, dst)
+	}
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, e := range entries {
+		if suffix, ok := strings.CutPrefix(e.Name(), name); ok && len(suffix) == len(backupTime) {
+			backups = append(backups, e.Name())
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > f.backups {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// list lists every file under the root.
+func (a *API) list(c *fiber.Ctx) error {
+	entries, err := a.files.list(a.files.root)
+	if err != nil {
+		return err
+	}
+	return c.JSON(entries)
+}
+
+// get sends a file, or lists a directory.
+func (a *API) get(c *fiber.Ctx) error {
+	p, err := a.files.resolve(c.Params("*"))
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return fiber.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := a.files.list(p)
+		if err != nil {
+			return err
+		}
+		return c.JSON(entries)
+	}
+	return c.SendFile(p)
+}
+
+func (a *API) put(c *fiber.Ctx) error {
+	p, err := a.files.resolve(c.Params("*"))
+	if err != nil {
+		return err
+	}
+	if p == a.files.root {
+		return fiber.NewError(fiber.StatusConflict, "path is a directory")
+	}
+	if filepath.Ext(p) == ".lua" {
+		// refuse to save scripts that would fail to load
+		if _, err := lut.ParseLuaSource(bytes.NewReader(c.Body()), a.files.rel(p)); err != nil {
+			return fiber.NewError(fiber.StatusUnprocessableEntity, err.Error())
+		}
+	}
+	created, err := a.files.write(p, c.Body())
+	if err != nil {
+		return err
+	}
+	a.audit(c, "write", "path", a.files.rel(p), "bytes", len(c.Body()))
+	if created {
+		c.Status(fiber.StatusCreated)
+	}
+	return c.SendString("ok")
+}
+
+func (a *API) delete(c *fiber.Ctx) error {
+	p, err := a.files.resolve(c.Params("*"))
+	if err != nil {
+		return err
+	}
+	if err := a.files.remove(p); errors.Is(err, os.ErrNotExist) {
+		return fiber.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	a.audit(c, "delete", "path", a.files.rel(p))
+	return c.SendString("ok")
+}
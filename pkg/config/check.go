@@ -0,0 +1,317 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Drivers supported by the db module.
+var Drivers = []string{"sqlite3", "mysql", "postgres"}
+
+// Check verifies the values of a parsed manifest: paths must exist and
+// addresses must be well-formed.
+func (c Config) Check() error {
+	var errs Errors
+	checkPath(&errs, "index", c.Index, false)
+	if c.Root != "" {
+		checkPath(&errs, "root", c.Root, true)
+	}
+	if c.DataPath != "" {
+		checkPath(&errs, "data_path", c.DataPath, true)
+	}
+	checkBase(&errs, "api_base", c.ApiBase)
+	checkBase(&errs, "admin_base", c.AdminBase)
+	if c.Workers < 1 {
+		errs.add("workers", "must be at least 1")
+	}
+	for i, l := range c.Listeners {
+		l.check(&errs, "listeners["+strconv.Itoa(i+1)+"]")
+	}
+	c.DB.check(&errs, "db")
+	names := make([]string, 0, len(c.Databases))
+	for name := range c.Databases {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		db, key := c.Databases[name], join("databases", name)
+		if !sqlIdent.MatchString(name) || strings.Contains(name, ".") {
+			errs.add(key, "expected a name of letters, digits and underscores")
+		} else if slices.Contains(reservedDBNames, name) {
+			errs.add(key, "%s is reserved, use another name", name)
+		}
+		db.check(&errs, key)
+	}
+	c.Middleware.check(&errs, "middleware")
+	c.Log.check(&errs, "log")
+	checkBase(&errs, "metrics.path", c.Metrics.Path)
+	if c.Metrics.Enabled && !c.Metrics.Public && !c.Admin.Enabled {
+		errs.add("metrics.enabled", "requires admin.enabled to authenticate scrapers, or metrics.public")
+	}
+	if c.Trace.Enabled {
+		c.Trace.check(&errs, "trace")
+	}
+	if c.Health.Enabled {
+		c.Health.check(&errs, "health")
+	}
+	if c.Admin.Enabled {
+		c.Admin.check(&errs, "admin", c.Listeners)
+	}
+	if slices.Contains(c.Middleware.Use, "pprof") && !c.Admin.Enabled {
+		// profiles and heap dumps are served to admins only
+		errs.add("middleware.use", "pprof requires admin.enabled")
+	}
+	for name, file := range c.Commands {
+		checkPath(&errs, join("commands", name), file, false)
+	}
+	if c.Restart.OnCrash != "" {
+		checkPath(&errs, "restart.on_crash", c.Restart.OnCrash, false)
+	}
+	return errs.err()
+}
+
+func (l Listener) check(errs *Errors, key string) {
+	switch l.Type {
+	case ListenHTTP, ListenHTTPS, ListenRedirect:
+		checkAddr(errs, join(key, "listen"), l.Listen)
+	case ListenUnix:
+		checkPath(errs, join(key, "listen"), filepath.Dir(l.Listen), true)
+	default:
+		types := []string{ListenHTTP, ListenHTTPS, ListenRedirect, ListenUnix}
+		errs.add(join(key, "type"), "unknown listener type %q%s", l.Type, suggest(l.Type, types))
+	}
+	if l.Type == ListenHTTPS {
+		certs := l.Certs
+		if l.Cert != "" || l.Key != "" {
+			certs = append([]Cert{{Cert: l.Cert, Key: l.Key}}, certs...)
+		}
+		if len(certs) == 0 {
+			errs.add(key, "https requires cert and key")
+		}
+		for _, c := range certs {
+			checkPath(errs, join(key, "cert"), c.Cert, false)
+			checkPath(errs, join(key, "key"), c.Key, false)
+		}
+	}
+	if l.To != "" {
+		if u, err := url.Parse(l.To); err != nil || u.Scheme == "" || u.Host == "" {
+			errs.add(join(key, "to"), "expected an absolute url like https://example.com, got %q", l.To)
+		}
+	}
+}
+
+func (db DB) check(errs *Errors, key string) {
+	known := false
+	for _, d := range Drivers {
+		known = known || d == db.Driver
+	}
+	if !known {
+		errs.add(join(key, "driver"), "unknown driver %q%s", db.Driver, suggest(db.Driver, Drivers))
+	}
+	if db.SQLPath != "" {
+		checkPath(errs, join(key, "sql_path"), db.SQLPath, true)
+	}
+	roles := []string{RolePrimary, RoleReplica}
+	if !slices.Contains(roles, db.Role) {
+		errs.add(join(key, "role"), "unknown role %q%s", db.Role, suggest(db.Role, roles))
+	}
+	if db.MaxConnections < 0 {
+		errs.add(join(key, "max_connections"), "must not be negative")
+	}
+	if db.MaxIdle < -1 {
+		errs.add(join(key, "max_idle"), "must be at least -1")
+	}
+	if db.ConnMaxLifetime < 0 {
+		errs.add(join(key, "conn_max_lifetime"), "must not be negative")
+	}
+	if db.ConnMaxIdleTime < 0 {
+		errs.add(join(key, "conn_max_idle_time"), "must not be negative")
+	}
+	if db.Timeout < 0 {
+		errs.add(join(key, "timeout"), "must not be negative")
+	}
+	db.Types.check(errs, join(key, "types"))
+	if db.Migrations.Auto {
+		checkPath(errs, join(key, "migrations.path"), db.Migrations.Path, true)
+	}
+	if !sqlIdent.MatchString(db.Migrations.Table) {
+		errs.add(join(key, "migrations.table"), "expected a table name, got %q", db.Migrations.Table)
+	}
+}
+
+// fields of db that databases cannot be named after
+var reservedDBNames = []string{"reader", "writer", "sqlpath"}
+
+var sqlIdent = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+func (t DBTypes) check(errs *Errors, key string) {
+	for _, f := range []struct {
+		name, value string
+		choices     []string
+	}{
+		{"time", t.Time, []string{"rfc3339", "unix", "table"}},
+		{"decimal", t.Decimal, []string{"string", "number"}},
+		{"json", t.JSON, []string{"table", "string"}},
+		{"bigint", t.BigInt, []string{"string", "number"}},
+	} {
+		if f.value != "" && !slices.Contains(f.choices, f.value) {
+			errs.add(join(key, f.name), "unknown type %q%s", f.value, suggest(f.value, f.choices))
+		}
+	}
+}
+
+func (l Log) check(errs *Errors, key string) {
+	formats := []string{LogText, LogJSON, LogLogfmt}
+	if !slices.Contains(formats, l.Format) {
+		errs.add(join(key, "format"), "unknown format %q%s", l.Format, suggest(l.Format, formats))
+	}
+	if !slices.Contains(LogLevels, l.Level) {
+		errs.add(join(key, "level"), "unknown level %q%s", l.Level, suggest(l.Level, LogLevels))
+	}
+	if l.File != "" {
+		checkPath(errs, join(key, "file"), filepath.Dir(l.File), true)
+	}
+	if l.MaxSize < 0 {
+		errs.add(join(key, "max_size"), "must not be negative")
+	}
+	if l.MaxFiles < 1 {
+		errs.add(join(key, "max_files"), "must be at least 1")
+	}
+	if l.SlowQuery < 0 {
+		errs.add(join(key, "slow_query"), "must not be negative")
+	}
+}
+
+func (t Trace) check(errs *Errors, key string) {
+	switch t.Exporter {
+	case TraceOTLP:
+		if u, err := url.Parse(t.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			errs.add(join(key, "endpoint"), "expected an absolute url, got %q", t.Endpoint)
+		}
+	case TraceFile:
+		if t.File == "" {
+			errs.add(join(key, "file"), "required by the file exporter")
+		} else {
+			checkPath(errs, join(key, "file"), filepath.Dir(t.File), true)
+		}
+	default:
+		exporters := []string{TraceOTLP, TraceFile}
+		errs.add(join(key, "exporter"), "unknown exporter %q%s", t.Exporter, suggest(t.Exporter, exporters))
+	}
+	if t.Sample < 0 || t.Sample > 1 {
+		errs.add(join(key, "sample"), "must be between 0 and 1")
+	}
+}
+
+func (h Health) check(errs *Errors, key string) {
+	checkBase(errs, join(key, "live"), h.Live)
+	checkBase(errs, join(key, "ready"), h.Ready)
+	if h.Live == h.Ready {
+		errs.add(join(key, "ready"), "must differ from %s", join(key, "live"))
+	}
+	if h.Timeout < 1 {
+		errs.add(join(key, "timeout"), "must be at least 1")
+	}
+	if h.ShutdownDelay < 0 {
+		errs.add(join(key, "shutdown_delay"), "must not be negative")
+	}
+}
+
+func (a Admin) check(errs *Errors, key string, listeners []Listener) {
+	if len(a.Tokens) == 0 && a.ClientCA == "" {
+		errs.add(key, "requires tokens or client_ca")
+	}
+	for i, t := range a.Tokens {
+		if len(t) < 16 {
+			errs.add(join(key, "tokens["+strconv.Itoa(i+1)+"]"), "must be at least 16 characters")
+		}
+	}
+	if a.ClientCA != "" {
+		checkPath(errs, join(key, "client_ca"), a.ClientCA, false)
+		https := slices.ContainsFunc(listeners, func(l Listener) bool {
+			return l.Type == ListenHTTPS
+		})
+		if !https {
+			errs.add(join(key, "client_ca"), "requires an https listener")
+		}
+	}
+	checkPath(errs, join(key, "root"), a.Root, true)
+	if a.Backups < -1 {
+		errs.add(join(key, "backups"), "must be -1 or more")
+	}
+}
+
+func (m Middleware) check(errs *Errors, key string) {
+	seen := make(map[string]bool)
+	for i, name := range m.Use {
+		k := fmt.Sprintf("%s[%d]", join(key, "use"), i+1)
+		if !slices.Contains(Middlewares, name) {
+			errs.add(k, "unknown middleware %q%s", name, suggest(name, Middlewares))
+		} else if seen[name] {
+			errs.add(k, "%s is used twice", name)
+		}
+		seen[name] = true
+	}
+	if m.BodyLimit < 0 {
+		errs.add(join(key, "body_limit"), "must not be negative")
+	}
+	if m.Favicon.File != "" {
+		checkPath(errs, join(key, "favicon.file"), m.Favicon.File, false)
+	}
+	if m.CORS.Credentials && (len(m.CORS.Origins) == 0 || slices.Contains(m.CORS.Origins, "*")) {
+		errs.add(join(key, "cors.credentials"), "requires explicit origins, browsers reject credentials with *")
+	}
+	levels := []string{CompressDisabled, CompressDefault, CompressSpeed, CompressBest}
+	if !slices.Contains(levels, m.Compress.Level) {
+		errs.add(join(key, "compress.level"), "unknown level %q%s", m.Compress.Level, suggest(m.Compress.Level, levels))
+	}
+	checkBase(errs, join(key, "pprof.prefix"), m.Pprof.Prefix)
+}
+
+func checkPath(errs *Errors, key, p string, dir bool) {
+	if p == "" {
+		errs.add(key, "path is empty")
+		return
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			errs.add(key, "%s does not exist", p)
+		} else {
+			errs.add(key, "%v", err)
+		}
+		return
+	}
+	if dir && !info.IsDir() {
+		errs.add(key, "%s is not a directory", p)
+	}
+}
+
+func checkAddr(errs *Errors, key, addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		errs.add(key, "expected an address like :80 or 127.0.0.1:8080, got %q", addr)
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		if _, err := net.LookupPort("tcp", port); err != nil {
+			errs.add(key, "invalid port %q", port)
+		}
+	}
+	if strings.ContainsAny(host, " /") {
+		errs.add(key, "invalid host %q", host)
+	}
+}
+
+func checkBase(errs *Errors, key, base string) {
+	if !strings.HasPrefix(base, "/") {
+		errs.add(key, "must start with /, got %q", base)
+	}
+}
@@ -5,42 +5,320 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"slices"
 	"strings"
 
 	"github.com/cloudwindy/mirai/lib"
-	"github.com/joho/godotenv"
 	"github.com/yuin/gluamapper"
 	lua "github.com/yuin/gopher-lua"
 )
 
 var ProjectFileName = "project.lua"
 
+// Middlewares lists the built-in middleware.
+var Middlewares = []string{"favicon", "requestid", "logger", "cors", "compress", "helmet", "pprof", "limiter"}
+
+// DefaultMiddleware is used when the manifest does not set middleware.use.
+var DefaultMiddleware = []string{"favicon", "requestid", "logger", "cors", "compress"}
+
 type Config struct {
-	Index  string
-	Root   string
-	Listen string
+	// project version
+	Version string `lua:"version"`
+	Index   string `lua:"index"`
+	Root    string `lua:"root"`
+	Listen  string `lua:"listen"`
+	// all listeners, defaults to plain http on Listen
+	Listeners []Listener `lua:"listeners"`
+
+	ApiBase   string `lua:"api_base"`
+	AdminBase string `lua:"admin_base"`
+	DataPath  string `lua:"data_path"`
+	// enables the admin api, kept for old manifests
+	Editing bool   `lua:"editing"`
+	Pid     string `lua:"pid"`
+	// control socket
+	Control string `lua:"control"`
+	// number of worker processes
+	Workers int `lua:"workers"`
+	// seconds to wait for in-flight requests on shutdown and reload
+	Drain int `lua:"drain"`
+	// seconds to wait for a new worker to become ready
+	ReadyTimeout int               `lua:"ready_timeout"`
+	Restart      Restart           `lua:"restart"`
+	DB           DB                `lua:"db"`
+	Databases    map[string]DB     `lua:"databases"`
+	Limiter      Limiter           `lua:"limiter"`
+	Middleware   Middleware        `lua:"middleware"`
+	Log          Log               `lua:"log"`
+	Metrics      Metrics           `lua:"metrics"`
+	Trace        Trace             `lua:"trace"`
+	Health       Health            `lua:"health"`
+	Admin        Admin             `lua:"admin"`
+	Commands     map[string]string `lua:"commands"`
+	Env          map[string]any    `lua:"env"`
+}
+
+// Listener types
+const (
+	ListenHTTP     = "http"
+	ListenHTTPS    = "https"
+	ListenRedirect = "redirect"
+	ListenUnix     = "unix"
+)
+
+type Listener struct {
+	// http, https, redirect or unix
+	Type string `lua:"type"`
+	// address, or socket path for unix
+	Listen string `lua:"listen"`
+	// https certificate and key files
+	Cert string `lua:"cert"`
+	Key  string `lua:"key"`
+	// more certificates for https, chosen by SNI
+	Certs []Cert `lua:"certs"`
+	// redirect target, defaults to https on the requested host
+	To string `lua:"to"`
+}
 
-	ApiBase   string
-	AdminBase string
-	DataPath  string
-	Editing   bool
-	Pid       string
-	DB        DB
-	Limiter   Limiter
-	Commands  map[string]string
-	Env       map[string]any
+type Cert struct {
+	Cert string `lua:"cert"`
+	Key  string `lua:"key"`
 }
 
 type DB struct {
-	Driver  string
-	Conn    string
-	SQLPath string
+	Driver  string `lua:"driver"`
+	Conn    string `lua:"conn"`
+	SQLPath string `lua:"sql_path"`
+	// primary or replica, replicas serve db:reader()
+	Role string `lua:"role"`
+	// open connections, 0 for no limit
+	MaxConnections int `lua:"max_connections"`
+	// idle connections kept, 0 for the default of database/sql, -1 for none
+	MaxIdle int `lua:"max_idle"`
+	// seconds a connection is reused and may be idle, 0 for no limit
+	ConnMaxLifetime float64 `lua:"conn_max_lifetime"`
+	ConnMaxIdleTime float64 `lua:"conn_max_idle_time"`
+	// fail to open if the database cannot be reached
+	Ping bool `lua:"ping"`
+	// seconds a call may run, 0 for no limit
+	Timeout    float64    `lua:"timeout"`
+	Types      DBTypes    `lua:"types"`
+	Migrations Migrations `lua:"migrations"`
+}
+
+// Roles of databases.
+const (
+	RolePrimary = "primary"
+	RoleReplica = "replica"
+)
+
+func (db *DB) defaults() {
+	if db.Driver == "" {
+		// e.g. only conn is set from the environment
+		db.Driver = "sqlite3"
+	}
+	if db.Role == "" {
+		db.Role = RolePrimary
+	}
+	if db.Migrations.Path == "" {
+		db.Migrations.Path = "migrations"
+	}
+	if db.Migrations.Table == "" {
+		db.Migrations.Table = "schema_migrations"
+	}
+}
+
+// Migrations of the schema, see ledb.Migrator.
+type Migrations struct {
+	// directory of the migration files
+	Path string `lua:"path"`
+	// history table
+	Table string `lua:"table"`
+	// apply pending migrations before starting the server
+	Auto bool `lua:"auto"`
+}
+
+// DBTypes controls how column values are returned to Lua, empty fields
+// keep the default, the first of their choices.
+type DBTypes struct {
+	// rfc3339, unix or table
+	Time string `lua:"time"`
+	// string or number
+	Decimal string `lua:"decimal"`
+	// table or string
+	JSON string `lua:"json"`
+	// string or number, for integers beyond 2^53
+	BigInt string `lua:"bigint"`
+}
+
+// Restart policy for crashed workers.
+type Restart struct {
+	// backoff in seconds
+	MinBackoff float64 `lua:"min_backoff"`
+	MaxBackoff float64 `lua:"max_backoff"`
+	// crashes allowed within window seconds, -1 for unlimited
+	MaxRestarts int     `lua:"max_restarts"`
+	Window      float64 `lua:"window"`
+	// crash log file
+	Log string `lua:"log"`
+	// Lua script to run on crash
+	OnCrash string `lua:"on_crash"`
+}
+
+// Log formats
+const (
+	LogText   = "text"
+	LogJSON   = "json"
+	LogLogfmt = "logfmt"
+)
+
+// Log levels
+var LogLevels = []string{"debug", "info", "warn", "error"}
+
+type Log struct {
+	// text keeps the access log format of the logger middleware, json and
+	// logfmt write access records like every other log record
+	Format string `lua:"format"`
+	// debug, info, warn or error
+	Level string `lua:"level"`
+	// log file, stdout if empty
+	File string `lua:"file"`
+	// rotate the file at this size in megabytes, 0 to never rotate
+	MaxSize int `lua:"max_size"`
+	// rotated files to keep
+	MaxFiles int `lua:"max_files"`
+	// seconds after which a database statement is logged, 0 to log none
+	SlowQuery float64 `lua:"slow_query"`
+}
+
+// Prometheus metrics, served on the admin group.
+type Metrics struct {
+	Enabled bool   `lua:"enabled"`
+	Path    string `lua:"path"`
+	// serve without the admin authentication
+	Public bool `lua:"public"`
+}
+
+// Trace exporters
+const (
+	TraceOTLP = "otlp"
+	TraceFile = "file"
+)
+
+// Request tracing.
+type Trace struct {
+	Enabled bool `lua:"enabled"`
+	// service name reported to the collector
+	Service string `lua:"service"`
+	// otlp or file
+	Exporter string `lua:"exporter"`
+	// OTLP/HTTP traces url
+	Endpoint string            `lua:"endpoint"`
+	Headers  map[string]string `lua:"headers"`
+	// file for the file exporter
+	File string `lua:"file"`
+	// fraction of new traces to record
+	Sample float64 `lua:"sample"`
+}
+
+// Liveness and readiness probes, served at the root.
+type Health struct {
+	Enabled bool   `lua:"enabled"`
+	Live    string `lua:"live"`
+	Ready   string `lua:"ready"`
+	// seconds allowed for the readiness checks
+	Timeout int `lua:"timeout"`
+	// seconds to report not ready before shutting down
+	ShutdownDelay int `lua:"shutdown_delay"`
+}
+
+// Remote administration api, served on the admin group.
+type Admin struct {
+	Enabled bool `lua:"enabled"`
+	// bearer tokens accepted
+	Tokens []string `lua:"tokens"`
+	// CA file verifying client certificates on https listeners, a verified
+	// certificate is accepted like a token
+	ClientCA string `lua:"client_ca"`
+	// directory managed by the files api, defaults to index or its directory
+	Root string `lua:"root"`
+	// previous versions kept of every written or deleted file, -1 for none
+	Backups int `lua:"backups"`
+	// serve the web console
+	Console bool `lua:"console"`
+}
+
+// Built-in middleware.
+type Middleware struct {
+	// enabled middleware, in order
+	Use []string `lua:"use"`
+	// maximum request body size in bytes
+	BodyLimit int       `lua:"body_limit"`
+	Favicon   Favicon   `lua:"favicon"`
+	RequestID RequestID `lua:"requestid"`
+	Logger    Logger    `lua:"logger"`
+	CORS      CORS      `lua:"cors"`
+	Compress  Compress  `lua:"compress"`
+	Helmet    Helmet    `lua:"helmet"`
+	Pprof     Pprof     `lua:"pprof"`
+	Limiter   Limiter   `lua:"limiter"`
+}
+
+type Favicon struct {
+	File string `lua:"file"`
+}
+
+type RequestID struct {
+	Header string `lua:"header"`
+}
+
+type Logger struct {
+	Format     string `lua:"format"`
+	TimeFormat string `lua:"time_format"`
+}
+
+type CORS struct {
+	Origins     []string `lua:"origins"`
+	Methods     []string `lua:"methods"`
+	Headers     []string `lua:"headers"`
+	Expose      []string `lua:"expose"`
+	Credentials bool     `lua:"credentials"`
+	// seconds to cache preflight results
+	MaxAge int `lua:"max_age"`
+}
+
+// Compression levels
+const (
+	CompressDisabled = "disabled"
+	CompressDefault  = "default"
+	CompressSpeed    = "speed"
+	CompressBest     = "best"
+)
+
+type Compress struct {
+	Level string `lua:"level"`
+}
+
+// Security headers, empty values keep the defaults of helmet.
+type Helmet struct {
+	ContentSecurityPolicy string `lua:"content_security_policy"`
+	XFrameOptions         string `lua:"x_frame_options"`
+	ReferrerPolicy        string `lua:"referrer_policy"`
+	PermissionsPolicy     string `lua:"permissions_policy"`
+	HSTSMaxAge            int    `lua:"hsts_max_age"`
+	HSTSPreload           bool   `lua:"hsts_preload"`
+	HSTSExcludeSubdomains bool   `lua:"hsts_exclude_subdomains"`
+}
+
+type Pprof struct {
+	// prefix of /debug/pprof, defaults to the admin path
+	Prefix string `lua:"prefix"`
 }
 
 type Limiter struct {
-	Enabled bool
-	Max     int
-	Dur     int
+	Enabled bool `lua:"enabled"`
+	Max     int  `lua:"max"`
+	Dur     int  `lua:"dur"`
 }
 
 func IsProject(projectDir string) (ok bool, err error) {
@@ -53,7 +331,11 @@ func IsProject(projectDir string) (ok bool, err error) {
 	return
 }
 
-func Parse(projectDir string) (c Config, err error) {
+// Parse reads the manifest in projectDir. A non-empty profile layers
+// project.<profile>.lua and .env.<profile> over the base files. Variables
+// from .env files and the environment override keys of the manifest, see
+// EnvPrefix.
+func Parse(projectDir string, profile string) (c Config, err error) {
 	L := lua.NewState(lua.Options{
 		SkipOpenLibs: true,
 	})
@@ -67,26 +349,19 @@ func Parse(projectDir string) (c Config, err error) {
 		return
 	}
 	t := L.CheckTable(1)
-	mapper := gluamapper.NewMapper(gluamapper.Option{
-		TagName: "lua",
-		NameFunc: func(s string) string {
-			return s
-		},
-	})
-	c.Env = make(map[string]any)
-	if err = mapper.Map(t, &c); err != nil {
-		return
+	if profile != "" {
+		if err = loadProfile(L, t, profile); err != nil {
+			return
+		}
 	}
 
-	env, err := godotenv.Read()
-	if errors.Is(err, os.ErrNotExist) {
-		err = nil
-	}
+	env, err := readEnv(profile)
 	if err != nil {
 		return
 	}
+	dotenv := make(map[string]string, len(env))
 	for k, v := range env {
-		c.Env[k] = v
+		dotenv[k] = v
 	}
 	for _, rawEnv := range os.Environ() {
 		k, v, ok := strings.Cut(rawEnv, "=")
@@ -95,6 +370,31 @@ func Parse(projectDir string) (c Config, err error) {
 		}
 		env[k] = v
 	}
+	if err = overrideEnv(L, t, env, dotenv); err != nil {
+		return
+	}
+
+	if err = Validate(t); err != nil {
+		return
+	}
+	// 0 is a valid sample, so it is defaulted only if it is missing
+	sampleSet := false
+	if trace, ok := t.RawGetString("trace").(*lua.LTable); ok {
+		sampleSet = trace.RawGetString("sample") != lua.LNil
+	}
+	mapper := gluamapper.NewMapper(gluamapper.Option{
+		TagName: "lua",
+		NameFunc: func(s string) string {
+			return s
+		},
+	})
+	c.Env = make(map[string]any)
+	if err = mapper.Map(t, &c); err != nil {
+		return
+	}
+	for k, v := range dotenv {
+		c.Env[k] = v
+	}
 	for k, v := range env {
 		switch k {
 		case "INDEX":
@@ -111,6 +411,7 @@ func Parse(projectDir string) (c Config, err error) {
 		"LISTEN":   c.Listen,
 		"DATAPATH": c.DataPath,
 		"SQLPATH":  c.DB.SQLPath,
+		"PROFILE":  profile,
 	}
 	for k, v := range env {
 		c.Env[k] = v
@@ -123,18 +424,106 @@ func Parse(projectDir string) (c Config, err error) {
 	if c.Listen == "" {
 		c.Listen = ":80"
 	}
-	if c.DB.Driver == "" && c.DB.Conn == "" {
-		c.DB = DB{
-			Driver: "sqlite3",
-			Conn:   ":memory:",
+	if len(c.Listeners) == 0 {
+		c.Listeners = []Listener{{Listen: c.Listen}}
+	}
+	for i := range c.Listeners {
+		if c.Listeners[i].Type == "" {
+			c.Listeners[i].Type = ListenHTTP
 		}
 	}
+	if main, ok := c.Databases["main"]; ok && c.DB.Driver == "" && c.DB.Conn == "" {
+		// db is the main database
+		c.DB = main
+	}
+	if c.DB.Driver == "" && c.DB.Conn == "" {
+		c.DB.Driver = "sqlite3"
+		c.DB.Conn = ":memory:"
+	}
+	c.DB.defaults()
+	for name, db := range c.Databases {
+		db.defaults()
+		c.Databases[name] = db
+	}
 	if c.AdminBase == "" {
 		c.AdminBase = "/admin"
 	}
 	if c.ApiBase == "" {
 		c.ApiBase = "/api"
 	}
+	if c.Workers < 1 {
+		c.Workers = 1
+	}
+	if c.Drain == 0 {
+		c.Drain = 10
+	}
+	if c.ReadyTimeout == 0 {
+		c.ReadyTimeout = 30
+	}
+	if c.Middleware.Use == nil {
+		c.Middleware.Use = slices.Clone(DefaultMiddleware)
+	}
+	if l := c.Limiter; l.Enabled && c.Middleware.Limiter == (Limiter{}) {
+		// the limiter used to be configured at the top level
+		c.Middleware.Limiter = l
+	}
+	if c.Middleware.Limiter.Enabled && !slices.Contains(c.Middleware.Use, "limiter") {
+		c.Middleware.Use = append(c.Middleware.Use, "limiter")
+	}
+	if c.Middleware.Compress.Level == "" {
+		c.Middleware.Compress.Level = CompressDefault
+	}
+	if c.Middleware.Pprof.Prefix == "" {
+		c.Middleware.Pprof.Prefix = path.Join(c.ApiBase, c.AdminBase)
+	}
+	if c.Metrics.Path == "" {
+		c.Metrics.Path = "/metrics"
+	}
+	if c.Trace.Service == "" {
+		c.Trace.Service = "mirai"
+	}
+	if c.Trace.Exporter == "" {
+		c.Trace.Exporter = TraceOTLP
+	}
+	if c.Trace.Endpoint == "" {
+		c.Trace.Endpoint = "http://localhost:4318/v1/traces"
+	}
+	if !sampleSet {
+		c.Trace.Sample = 1
+	}
+	if c.Health.Live == "" {
+		c.Health.Live = "/healthz"
+	}
+	if c.Health.Ready == "" {
+		c.Health.Ready = "/readyz"
+	}
+	if c.Health.Timeout == 0 {
+		c.Health.Timeout = 5
+	}
+	if c.Editing {
+		c.Admin.Enabled = true
+	}
+	if c.Admin.Root == "" {
+		c.Admin.Root = c.Index
+		if path.Ext(c.Index) == ".lua" {
+			c.Admin.Root = path.Dir(c.Index)
+		}
+	}
+	if c.Admin.Backups == 0 {
+		c.Admin.Backups = 5
+	}
+	if c.Log.Format == "" {
+		c.Log.Format = LogText
+	}
+	if c.Log.Level == "" {
+		c.Log.Level = "info"
+	}
+	if c.Log.MaxFiles == 0 {
+		c.Log.MaxFiles = 5
+	}
+	if c.Restart.MaxRestarts == 0 {
+		c.Restart.MaxRestarts = 10
+	}
 
 	return
 }
@@ -0,0 +1,223 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Environment variables starting with EnvPrefix override manifest keys,
+// e.g. MIRAI_DB_CONN sets db.conn and MIRAI_LISTENERS_1_LISTEN sets
+// listeners[1].listen.
+const EnvPrefix = "MIRAI_"
+
+// EnvProfile selects the profile when none is given on the command line.
+const EnvProfile = EnvPrefix + "PROFILE"
+
+// Warnf reports problems that do not stop the manifest from loading, such
+// as unknown MIRAI_* variables in the environment.
+var Warnf = func(format string, a ...any) {
+	fmt.Fprintf(os.Stderr, "warn: "+format+"\n", a...)
+}
+
+var errUnknownKey = errors.New("unknown key")
+
+// ProfileFileName returns the manifest layered over project.lua for profile.
+func ProfileFileName(profile string) string {
+	return strings.TrimSuffix(ProjectFileName, ".lua") + "." + profile + ".lua"
+}
+
+// loadProfile merges project.<profile>.lua over the manifest table.
+// It fails if the profile has neither a manifest nor a .env file.
+func loadProfile(L *lua.LState, t *lua.LTable, profile string) error {
+	name := ProfileFileName(profile)
+	if _, err := os.Stat(name); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if _, err := os.Stat(".env." + profile); err != nil {
+			return fmt.Errorf("profile %s: neither %s nor .env.%s found", profile, name, profile)
+		}
+		return nil
+	}
+	if err := L.DoFile(name); err != nil {
+		return err
+	}
+	pt, ok := L.Get(-1).(*lua.LTable)
+	if !ok {
+		return fmt.Errorf("%s: expected a table, got %s", name, L.Get(-1).Type())
+	}
+	L.Pop(1)
+	merge(t, pt)
+	return nil
+}
+
+// merge copies the keys of src over dst. Nested tables are merged too,
+// except lists, which are replaced as a whole.
+func merge(dst, src *lua.LTable) {
+	src.ForEach(func(k, v lua.LValue) {
+		sv, ok := v.(*lua.LTable)
+		dv, dok := dst.RawGet(k).(*lua.LTable)
+		if ok && dok && sv.Len() == 0 && dv.Len() == 0 {
+			merge(dv, sv)
+			return
+		}
+		dst.RawSet(k, v)
+	})
+}
+
+// readEnv reads .env and then .env.<profile> over it.
+func readEnv(profile string) (map[string]string, error) {
+	env := make(map[string]string)
+	files := []string{".env"}
+	if profile != "" {
+		files = append(files, ".env."+profile)
+	}
+	for _, file := range files {
+		m, err := godotenv.Read(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range m {
+			env[k] = v
+		}
+	}
+	return env, nil
+}
+
+// overrideEnv applies the MIRAI_* variables in env to the manifest table.
+// Unknown keys of variables that are not from .env files only warn, since
+// the environment may hold MIRAI_* variables of other tools.
+func overrideEnv(L *lua.LState, t *lua.LTable, env, dotenv map[string]string) error {
+	var errs Errors
+	names := keys(env)
+	slices.Sort(names)
+	for _, name := range names {
+		value := env[name]
+		if !strings.HasPrefix(name, EnvPrefix) || name == EnvProfile {
+			continue
+		}
+		path := strings.Split(strings.TrimPrefix(name, EnvPrefix), "_")
+		err := override(L, t, reflect.TypeOf(Config{}), path, value)
+		if _, ok := dotenv[name]; !ok && errors.Is(err, errUnknownKey) {
+			Warnf("%s ignored: %v", name, err)
+			continue
+		}
+		if err != nil {
+			errs.add(name, "%v", err)
+		}
+	}
+	return errs.err()
+}
+
+// override sets the value at path, creating tables on the way. Keys may
+// contain underscores themselves, so the longest matching key wins.
+func override(L *lua.LState, t *lua.LTable, typ reflect.Type, path []string, value string) error {
+	switch typ.Kind() {
+	case reflect.Struct:
+		fields := structFields(typ)
+		for n := len(path); n > 0; n-- {
+			key := strings.ToLower(strings.Join(path[:n], "_"))
+			f, ok := fields[key]
+			if !ok {
+				continue
+			}
+			return overrideKey(L, t, lua.LString(key), f.Type, path[n:], value)
+		}
+		key := strings.ToLower(strings.Join(path, "_"))
+		return fmt.Errorf("%w %s%s", errUnknownKey, key, suggest(key, keys(fields)))
+	case reflect.Map:
+		if len(path) == 0 {
+			return errors.New("missing key")
+		}
+		switch typ.Elem().Kind() {
+		case reflect.Struct, reflect.Map, reflect.Slice:
+		default:
+			// the whole path, matching an existing key regardless of case
+			key, ok := findKey(t, strings.Join(path, "_"))
+			if !ok {
+				key = lua.LString(strings.Join(path, "_"))
+			}
+			return overrideKey(L, t, key, typ.Elem(), nil, value)
+		}
+		// the longest key of an existing entry, else the first element
+		for n := len(path) - 1; n > 0; n-- {
+			if key, ok := findKey(t, strings.Join(path[:n], "_")); ok {
+				return overrideKey(L, t, key, typ.Elem(), path[n:], value)
+			}
+		}
+		return overrideKey(L, t, lua.LString(strings.ToLower(path[0])), typ.Elem(), path[1:], value)
+	case reflect.Slice:
+		if len(path) == 0 {
+			return errors.New("missing index")
+		}
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 1 {
+			return fmt.Errorf("invalid index %s", path[0])
+		}
+		return overrideKey(L, t, lua.LNumber(i), typ.Elem(), path[1:], value)
+	}
+	return errors.New("cannot be set")
+}
+
+// findKey returns the string key of t that equals name regardless of case.
+func findKey(t *lua.LTable, name string) (lua.LValue, bool) {
+	var found lua.LValue
+	t.ForEach(func(k, _ lua.LValue) {
+		if s, ok := k.(lua.LString); ok && found == nil && strings.EqualFold(string(s), name) {
+			found = k
+		}
+	})
+	return found, found != nil
+}
+
+func overrideKey(L *lua.LState, t *lua.LTable, key lua.LValue, typ reflect.Type, path []string, value string) error {
+	if len(path) == 0 {
+		v, err := envValue(typ, value)
+		if err != nil {
+			return err
+		}
+		t.RawSet(key, v)
+		return nil
+	}
+	if sub, ok := t.RawGet(key).(*lua.LTable); ok {
+		return override(L, sub, typ, path, value)
+	}
+	// only kept if the value is set, so that a failed key adds no table
+	sub := L.NewTable()
+	if err := override(L, sub, typ, path, value); err != nil {
+		return err
+	}
+	t.RawSet(key, sub)
+	return nil
+}
+
+func envValue(typ reflect.Type, value string) (lua.LValue, error) {
+	switch typ.Kind() {
+	case reflect.String, reflect.Interface:
+		return lua.LString(value), nil
+	case reflect.Int, reflect.Float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected number, got %q", value)
+		}
+		return lua.LNumber(n), nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("expected boolean, got %q", value)
+		}
+		return lua.LBool(b), nil
+	}
+	return nil, errors.New("cannot set a table from the environment")
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Errors collects every problem found in a manifest.
+type Errors []error
+
+func (errs Errors) Error() string {
+	if len(errs) == 1 {
+		return ProjectFileName + ": " + errs[0].Error()
+	}
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "%s: %d problems", ProjectFileName, len(errs))
+	for _, err := range errs {
+		b.WriteString("\n  ")
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+func (errs *Errors) add(key string, format string, a ...any) {
+	*errs = append(*errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, a...)))
+}
+
+func (errs Errors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Validate checks the manifest table against the fields of Config,
+// reporting unknown keys and values of the wrong type.
+func Validate(t *lua.LTable) error {
+	var errs Errors
+	validate(&errs, "", t, reflect.TypeOf(Config{}))
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Error() < errs[j].Error()
+	})
+	return errs.err()
+}
+
+func validate(errs *Errors, key string, v lua.LValue, t reflect.Type) {
+	if v == lua.LNil {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		return
+	case reflect.String:
+		if _, ok := v.(lua.LString); !ok {
+			errs.add(key, "expected string, got %s", v.Type())
+		}
+	case reflect.Bool:
+		if _, ok := v.(lua.LBool); !ok {
+			errs.add(key, "expected boolean, got %s", v.Type())
+		}
+	case reflect.Int:
+		n, ok := v.(lua.LNumber)
+		if !ok {
+			errs.add(key, "expected integer, got %s", v.Type())
+		} else if float64(n) != math.Trunc(float64(n)) {
+			errs.add(key, "expected integer, got %v", n)
+		}
+	case reflect.Float64:
+		if _, ok := v.(lua.LNumber); !ok {
+			errs.add(key, "expected number, got %s", v.Type())
+		}
+	case reflect.Slice:
+		tb, ok := v.(*lua.LTable)
+		if !ok {
+			errs.add(key, "expected list, got %s", v.Type())
+			return
+		}
+		n := tb.Len()
+		tb.ForEach(func(k, item lua.LValue) {
+			if i, ok := k.(lua.LNumber); !ok || int(i) < 1 || int(i) > n {
+				errs.add(key, "expected list, got key %v", k)
+				return
+			}
+			validate(errs, fmt.Sprintf("%s[%v]", key, k), item, t.Elem())
+		})
+	case reflect.Map:
+		tb, ok := v.(*lua.LTable)
+		if !ok {
+			errs.add(key, "expected table, got %s", v.Type())
+			return
+		}
+		tb.ForEach(func(k, item lua.LValue) {
+			name, ok := k.(lua.LString)
+			if !ok {
+				errs.add(key, "expected string keys, got %v", k)
+				return
+			}
+			validate(errs, join(key, string(name)), item, t.Elem())
+		})
+	case reflect.Struct:
+		tb, ok := v.(*lua.LTable)
+		if !ok {
+			errs.add(key, "expected table, got %s", v.Type())
+			return
+		}
+		fields := structFields(t)
+		tb.ForEach(func(k, item lua.LValue) {
+			name, ok := k.(lua.LString)
+			if !ok {
+				errs.add(key, "expected string keys, got %v", k)
+				return
+			}
+			f, ok := fields[string(name)]
+			if !ok {
+				errs.add(join(key, string(name)), "unknown key%s", suggest(string(name), keys(fields)))
+				return
+			}
+			validate(errs, join(key, string(name)), item, f.Type)
+		})
+	}
+}
+
+// structFields maps the manifest keys of a struct to its fields.
+func structFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("lua")
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+func keys[V any](m map[string]V) []string {
+	list := make([]string, 0, len(m))
+	for k := range m {
+		list = append(list, k)
+	}
+	return list
+}
+
+func join(key, name string) string {
+	if key == "" {
+		return name
+	}
+	return key + "." + name
+}
+
+// suggest returns a hint naming the candidate closest to s, if any is close
+// enough to be a typo.
+func suggest(s string, candidates []string) string {
+	best, dist := "", len(s)/3+2
+	for _, c := range candidates {
+		if d := distance(s, c); d < dist || d == dist && c < best {
+			best, dist = c, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %q?", best)
+}
+
+// distance is the Levenshtein distance between a and b.
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
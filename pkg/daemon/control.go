@@ -0,0 +1,120 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Control socket timeout for a single command.
+var ControlTimeout = 60 * time.Second
+
+// ControlHandler handles a control command and returns its JSON result.
+type ControlHandler func() (any, error)
+
+// ControlServer serves commands on a local Unix socket.
+// The protocol is one command line in, one JSON response out.
+type ControlServer struct {
+	ln       net.Listener
+	handlers map[string]ControlHandler
+}
+
+type controlResponse struct {
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// Serve listens on the Unix socket at path. A stale socket left behind by a
+// dead process is replaced.
+func Serve(path string, handlers map[string]ControlHandler) (*ControlServer, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("control socket %s is in use", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	s := &ControlServer{ln: ln, handlers: handlers}
+	go s.serve()
+	return s, nil
+}
+
+// WorkerSocket returns the stats socket path of a worker.
+func WorkerSocket(path string, pid int) string {
+	return fmt.Sprintf("%s.%d", path, pid)
+}
+
+func (s *ControlServer) Close() error {
+	return s.ln.Close()
+}
+
+func (s *ControlServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *ControlServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ControlTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	var res controlResponse
+	cmd := strings.TrimSpace(line)
+	if handler, ok := s.handlers[cmd]; ok {
+		data, err := handler()
+		if err == nil {
+			res.Data, err = json.Marshal(data)
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+	} else {
+		res.Error = "unknown command: " + cmd
+	}
+	json.NewEncoder(conn).Encode(res)
+}
+
+// Call sends cmd to the control socket at path and decodes the result into v,
+// which may be nil.
+func Call(path, cmd string, v any) error {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ControlTimeout))
+	if _, err := fmt.Fprintln(conn, cmd); err != nil {
+		return err
+	}
+	var res controlResponse
+	if err := json.NewDecoder(conn).Decode(&res); err != nil {
+		return err
+	}
+	if res.Error != "" {
+		return errors.New(res.Error)
+	}
+	if v == nil || res.Data == nil {
+		return nil
+	}
+	return json.Unmarshal(res.Data, v)
+}
@@ -1,6 +1,8 @@
 package daemon
 
 import (
+	"errors"
+	"fmt"
 	"net"
 	"os"
 	"os/exec"
@@ -8,10 +10,21 @@ import (
 )
 
 const (
-	flagWorker = "__MIRAI_WORKER"
+	flagWorker   = "__MIRAI_WORKER"
+	envListeners = "__MIRAI_LISTENERS"
 )
 
-func Fork(wd string, ln *net.TCPListener) (proc *os.Process, err error) {
+// File descriptors inherited by a worker process.
+const (
+	fdReady = 3 + iota
+	fdListener
+)
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+func Fork(wd string, lns []net.Listener) (w *Worker, err error) {
 	ex, err := os.Executable()
 	if err != nil {
 		return
@@ -27,35 +40,79 @@ func Fork(wd string, ln *net.TCPListener) (proc *os.Process, err error) {
 		Stdout: os.Stdout,
 		Stderr: os.Stderr,
 	}
-	if ln != nil {
+	var ready *os.File
+	if lns != nil {
 		// worker process
-		var file *os.File
-		file, err = ln.File()
+		var rw *os.File
+		ready, rw, err = os.Pipe()
 		if err != nil {
 			return
 		}
+		defer rw.Close()
+		cmd.ExtraFiles = []*os.File{rw}
+		for _, ln := range lns {
+			f, ok := ln.(filer)
+			if !ok {
+				ready.Close()
+				return nil, fmt.Errorf("cannot pass %T to worker", ln)
+			}
+			var file *os.File
+			if file, err = f.File(); err != nil {
+				ready.Close()
+				return
+			}
+			defer file.Close()
+			cmd.ExtraFiles = append(cmd.ExtraFiles, file)
+		}
 		cmd.Args[0] = flagWorker
-		cmd.ExtraFiles = []*os.File{file}
+		cmd.Env = append(cmd.Env, envListeners+"="+strconv.Itoa(len(lns)))
 	}
 	err = cmd.Start()
 	if err != nil {
+		if ready != nil {
+			ready.Close()
+		}
 		return
 	}
-	return cmd.Process, nil
+	return newWorker(cmd.Process, ready), nil
 }
 
 func IsChild() bool {
 	return os.Args[0] == flagWorker
 }
 
-func Forked(listen string) (ln *net.TCPListener, err error) {
-	var listener net.Listener
-	if os.Args[0] == flagWorker {
-		listener, err = net.FileListener(os.NewFile(3, ""))
-	} else {
-		listener, err = net.Listen("tcp", listen)
+// Forked returns the listeners inherited from the parent process, or opens
+// them with listen if the current process is not a worker.
+func Forked(listen func() ([]net.Listener, error)) ([]net.Listener, error) {
+	if !IsChild() {
+		return listen()
+	}
+	n, err := strconv.Atoi(os.Getenv(envListeners))
+	if err != nil {
+		return nil, errors.New("no listeners inherited")
+	}
+	lns := make([]net.Listener, n)
+	for i := range lns {
+		file := os.NewFile(uintptr(fdListener+i), "")
+		lns[i], err = net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lns, nil
+}
+
+// Ready tells the parent process that the worker is accepting connections.
+// It does nothing if the current process is not a worker.
+func Ready() error {
+	if !IsChild() {
+		return nil
 	}
-	return listener.(*net.TCPListener), err
+	f := os.NewFile(fdReady, "")
+	defer f.Close()
+	_, err := f.Write([]byte{1})
+	return err
 }
 
 func WritePid(path string) error {
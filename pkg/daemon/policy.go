@@ -0,0 +1,75 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Policy decides how the supervisor restarts crashed workers.
+type Policy struct {
+	// restart backoff, doubled after each crash
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// give up after MaxRestarts crashes within Window, 0 means never
+	MaxRestarts int
+	Window      time.Duration
+	// file to append crash records to, empty to disable
+	CrashLog string
+	// called once for each crashed worker, before it is restarted. A worker
+	// that fails to start again is another crash.
+	OnCrash func(Crash)
+}
+
+var DefaultPolicy = Policy{
+	MinBackoff:  100 * time.Millisecond,
+	MaxBackoff:  30 * time.Second,
+	MaxRestarts: 10,
+	Window:      time.Minute,
+}
+
+func (p Policy) withDefaults() Policy {
+	if p.MinBackoff <= 0 {
+		p.MinBackoff = DefaultPolicy.MinBackoff
+	}
+	if p.MaxBackoff < p.MinBackoff {
+		p.MaxBackoff = max(DefaultPolicy.MaxBackoff, p.MinBackoff)
+	}
+	if p.Window <= 0 {
+		p.Window = DefaultPolicy.Window
+	}
+	return p
+}
+
+// Crash describes an abnormal worker exit, or a worker that failed to
+// start.
+type Crash struct {
+	// 0 if the worker could not be forked
+	Pid int
+	// e.g. "exit status 2" or "signal: killed"
+	Status string
+	// exit code, -1 if killed by a signal or not forked
+	Code   int
+	Uptime time.Duration
+	Time   time.Time
+	// crashes within the policy window, including this one
+	Restarts int
+}
+
+func (c Crash) String() string {
+	return fmt.Sprintf("%s worker %d crashed: %s (uptime %v, %d restarts)",
+		c.Time.Format(time.RFC3339), c.Pid, c.Status, c.Uptime.Round(time.Millisecond), c.Restarts)
+}
+
+func (c Crash) log(path string) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, c)
+	return err
+}
@@ -0,0 +1,387 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+var ErrTooManyRestarts = errors.New("too many worker restarts")
+
+// Supervisor forks and keeps alive a fixed number of workers sharing the
+// same listeners.
+type Supervisor struct {
+	Dir          string
+	Listeners    []net.Listener
+	Workers      int
+	Drain        time.Duration
+	ReadyTimeout time.Duration
+	Policy       Policy
+	// control socket, used to reach the workers' stats sockets
+	Control string
+	Logf    func(format string, a ...any)
+
+	started  time.Time
+	mu       sync.Mutex
+	reload   sync.Mutex
+	workers  []*Worker
+	restarts []time.Time
+	stopping bool
+	stop     chan struct{}
+	// closed and replaced on every reload
+	reloaded chan struct{}
+	err      error
+	wg       sync.WaitGroup
+}
+
+// Start forks all workers and waits for them to become ready.
+func (s *Supervisor) Start() error {
+	if s.Workers < 1 {
+		s.Workers = 1
+	}
+	s.Policy = s.Policy.withDefaults()
+	s.started = time.Now()
+	s.stop = make(chan struct{})
+	s.reloaded = make(chan struct{})
+	workers, err := s.spawnAll()
+	if err != nil {
+		return err
+	}
+	s.workers = workers
+	s.wg.Add(len(workers))
+	for i := range workers {
+		go s.watch(i)
+	}
+	return nil
+}
+
+// Reload replaces every worker. The old workers are drained only after all
+// of the new ones are ready; if any of them fails, the old ones keep serving.
+func (s *Supervisor) Reload() error {
+	s.reload.Lock()
+	defer s.reload.Unlock()
+	workers, err := s.spawnAll()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.stopping {
+		s.mu.Unlock()
+		killAll(workers)
+		return nil
+	}
+	old := s.workers
+	s.workers = workers
+	close(s.reloaded)
+	s.reloaded = make(chan struct{})
+	s.mu.Unlock()
+	for _, w := range old {
+		if w != nil {
+			go s.stopWorker(w)
+		}
+	}
+	return nil
+}
+
+// Stop drains all workers and stops restarting them.
+func (s *Supervisor) Stop() {
+	s.mu.Lock()
+	if s.stopping {
+		s.mu.Unlock()
+		return
+	}
+	s.stopping = true
+	close(s.stop)
+	workers := s.workers
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		if w == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(w *Worker) {
+			defer wg.Done()
+			s.stopWorker(w)
+		}(w)
+	}
+	wg.Wait()
+}
+
+// Wait blocks until every worker has exited for good. It returns
+// ErrTooManyRestarts if the supervisor gave up restarting crashed workers.
+func (s *Supervisor) Wait() error {
+	s.wg.Wait()
+	return s.err
+}
+
+// Status is the result of the status control command.
+type Status struct {
+	Pid     int            `json:"pid"`
+	Started time.Time      `json:"started"`
+	Uptime  float64        `json:"uptime"`
+	Workers []WorkerStatus `json:"workers"`
+}
+
+type WorkerStatus struct {
+	Pid    int     `json:"pid"`
+	Uptime float64 `json:"uptime"`
+	// reported by the worker itself
+	Stats json.RawMessage `json:"stats,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// Status reports the supervisor and its running workers.
+func (s *Supervisor) Status() Status {
+	s.mu.Lock()
+	workers := make([]*Worker, 0, len(s.workers))
+	for _, w := range s.workers {
+		if w != nil {
+			workers = append(workers, w)
+		}
+	}
+	s.mu.Unlock()
+
+	st := Status{
+		Pid:     os.Getpid(),
+		Started: s.started,
+		Uptime:  time.Since(s.started).Seconds(),
+		Workers: make([]WorkerStatus, len(workers)),
+	}
+	for i, w := range workers {
+		ws := WorkerStatus{
+			Pid:    w.Pid,
+			Uptime: time.Since(w.Started).Seconds(),
+		}
+		if s.Control != "" {
+			if err := Call(WorkerSocket(s.Control, w.Pid), "stats", &ws.Stats); err != nil {
+				ws.Error = err.Error()
+			}
+		}
+		st.Workers[i] = ws
+	}
+	return st
+}
+
+// watch restarts the worker in slot i whenever it crashes, for the
+// lifetime of the supervisor.
+func (s *Supervisor) watch(i int) {
+	defer s.wg.Done()
+	p := s.Policy
+	backoff := p.MinBackoff
+	for {
+		s.mu.Lock()
+		w := s.workers[i]
+		s.mu.Unlock()
+
+		state, _ := w.Wait()
+
+		s.mu.Lock()
+		if s.workers[i] != w {
+			// replaced on reload
+			s.mu.Unlock()
+			continue
+		}
+		if s.stopping {
+			s.workers[i] = nil
+			s.mu.Unlock()
+			return
+		}
+		if state.Success() {
+			// exited on its own, e.g. drained on a SIGTERM from outside.
+			// The slot is filled again on reload, the supervisor stops
+			// once no worker is left.
+			s.workers[i] = nil
+			left := slices.ContainsFunc(s.workers, func(w *Worker) bool { return w != nil })
+			reloaded := s.reloaded
+			s.mu.Unlock()
+			if !left {
+				s.Stop()
+				return
+			}
+			select {
+			case <-reloaded:
+				continue
+			case <-s.stop:
+				return
+			}
+		}
+		s.mu.Unlock()
+
+		crash := Crash{
+			Pid:    w.Pid,
+			Status: state.String(),
+			Code:   state.ExitCode(),
+			Uptime: time.Since(w.Started),
+			Time:   time.Now(),
+		}
+		if s.crashed(i, &crash) {
+			return
+		}
+		if crash.Uptime > p.MaxBackoff {
+			backoff = p.MinBackoff
+		}
+		s.logf("worker %d exited (%s), restarting in %v\n", w.Pid, crash.Status, backoff)
+		nw, ok := s.respawn(i, w, &backoff)
+		if !ok {
+			return
+		}
+		if nw == nil {
+			continue
+		}
+		s.mu.Lock()
+		if s.workers[i] != w || s.stopping {
+			s.mu.Unlock()
+			nw.Kill()
+			continue
+		}
+		s.workers[i] = nw
+		s.mu.Unlock()
+	}
+}
+
+// respawn starts the worker replacing w in slot i after backoff. A worker
+// that fails to start, e.g. on an error in the index script, is a crash
+// too and is retried with a growing backoff. It returns nil if the
+// supervisor stops or w is replaced on reload first, and false if it gave
+// up restarting.
+func (s *Supervisor) respawn(i int, w *Worker, backoff *time.Duration) (*Worker, bool) {
+	for {
+		select {
+		case <-time.After(*backoff):
+		case <-s.stop:
+			return nil, true
+		}
+		*backoff = min(*backoff*2, s.Policy.MaxBackoff)
+		s.mu.Lock()
+		replaced := s.workers[i] != w
+		s.mu.Unlock()
+		if replaced {
+			return nil, true
+		}
+		nw, err := s.start()
+		if err == nil {
+			return nw, true
+		}
+		crash := Crash{Status: err.Error(), Code: -1, Time: time.Now()}
+		if nw != nil {
+			state, _ := nw.Wait()
+			crash.Pid, crash.Uptime = nw.Pid, time.Since(nw.Started)
+			crash.Status = fmt.Sprintf("%v (%s)", err, state)
+			crash.Code = state.ExitCode()
+		}
+		if s.crashed(i, &crash) {
+			return nil, false
+		}
+		s.logf("worker start failed (%s), retrying in %v\n", crash.Status, *backoff)
+	}
+}
+
+// countRestart records a restart and returns the number of restarts within
+// the policy window. The caller must hold s.mu.
+func (s *Supervisor) countRestart() int {
+	now := time.Now()
+	kept := s.restarts[:0]
+	for _, t := range s.restarts {
+		if now.Sub(t) < s.Policy.Window {
+			kept = append(kept, t)
+		}
+	}
+	s.restarts = append(kept, now)
+	return len(s.restarts)
+}
+
+// crashed counts and reports the crash of the worker in slot i. It
+// reports whether the supervisor gave up, after too many crashes within
+// the policy window, and then stops it.
+func (s *Supervisor) crashed(i int, c *Crash) bool {
+	s.mu.Lock()
+	c.Restarts = s.countRestart()
+	s.mu.Unlock()
+	if err := c.log(s.Policy.CrashLog); err != nil {
+		s.logf("crash log: %v\n", err)
+	}
+	if s.Policy.OnCrash != nil {
+		s.Policy.OnCrash(*c)
+	}
+	p := s.Policy
+	if p.MaxRestarts <= 0 || c.Restarts <= p.MaxRestarts {
+		return false
+	}
+	s.logf("worker %d: %v in %v, giving up\n", c.Pid, ErrTooManyRestarts, p.Window)
+	s.mu.Lock()
+	s.err = ErrTooManyRestarts
+	s.workers[i] = nil
+	s.mu.Unlock()
+	go s.Stop()
+	return true
+}
+
+// start forks a worker and waits for it to become ready. A worker that
+// fails to is killed and returned with the error, nil if the fork failed.
+func (s *Supervisor) start() (*Worker, error) {
+	w, err := Fork(s.Dir, s.Listeners)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.WaitReady(s.ReadyTimeout); err != nil {
+		w.Kill()
+		return w, err
+	}
+	return w, nil
+}
+
+func (s *Supervisor) spawn() (*Worker, error) {
+	w, err := s.start()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (s *Supervisor) spawnAll() ([]*Worker, error) {
+	var (
+		wg      sync.WaitGroup
+		workers = make([]*Worker, s.Workers)
+		errs    = make([]error, s.Workers)
+	)
+	for i := range workers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			workers[i], errs[i] = s.spawn()
+		}(i)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		killAll(workers)
+		return nil, err
+	}
+	return workers, nil
+}
+
+func (s *Supervisor) stopWorker(w *Worker) {
+	if err := w.Stop(s.Drain); err != nil {
+		s.logf("worker %d stop: %v\n", w.Pid, err)
+	}
+}
+
+func (s *Supervisor) logf(format string, a ...any) {
+	if s.Logf != nil {
+		s.Logf(format, a...)
+	}
+}
+
+func killAll(workers []*Worker) {
+	for _, w := range workers {
+		if w != nil {
+			w.Kill()
+		}
+	}
+}
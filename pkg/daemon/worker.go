@@ -0,0 +1,100 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Extra time given to a worker after its drain timeout before it is killed.
+var StopGrace = 5 * time.Second
+
+var (
+	ErrNotReady     = errors.New("worker exited before ready")
+	ErrReadyTimeout = errors.New("worker ready timeout")
+)
+
+// Worker is a forked worker process.
+type Worker struct {
+	*os.Process
+	Started time.Time
+	ready   chan error
+	done    chan struct{}
+	state   *os.ProcessState
+	err     error
+}
+
+func newWorker(proc *os.Process, ready *os.File) *Worker {
+	w := &Worker{
+		Process: proc,
+		Started: time.Now(),
+		ready:   make(chan error, 1),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		w.state, w.err = proc.Wait()
+		close(w.done)
+	}()
+	if ready == nil {
+		w.ready <- nil
+		return w
+	}
+	go func() {
+		defer ready.Close()
+		buf := make([]byte, 1)
+		if n, _ := ready.Read(buf); n == 1 {
+			w.ready <- nil
+		} else {
+			w.ready <- ErrNotReady
+		}
+	}()
+	return w
+}
+
+// WaitReady blocks until the worker reports ready, exits or times out.
+// A zero timeout waits forever.
+func (w *Worker) WaitReady(timeout time.Duration) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case err := <-w.ready:
+		return err
+	case <-expired:
+		return ErrReadyTimeout
+	}
+}
+
+// Done is closed when the worker process has exited.
+func (w *Worker) Done() <-chan struct{} {
+	return w.done
+}
+
+// Wait blocks until the worker exits and returns its state.
+func (w *Worker) Wait() (*os.ProcessState, error) {
+	<-w.done
+	return w.state, w.err
+}
+
+// Stop asks the worker to shut down gracefully within timeout, and kills it
+// if it is still running after an extra grace period.
+func (w *Worker) Stop(timeout time.Duration) error {
+	if err := w.Signal(syscall.SIGTERM); err != nil {
+		if errors.Is(err, os.ErrProcessDone) {
+			return nil
+		}
+		return err
+	}
+	t := time.NewTimer(timeout + StopGrace)
+	defer t.Stop()
+	select {
+	case <-w.done:
+		return nil
+	case <-t.C:
+		return w.Kill()
+	}
+}
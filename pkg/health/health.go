@@ -0,0 +1,134 @@
+// Package health serves liveness and readiness probes.
+package health
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Check reports a problem with a dependency. It should return once ctx is
+// done.
+type Check func(ctx context.Context) error
+
+// Health tracks readiness and the checks run for each readiness probe.
+type Health struct {
+	// time allowed for all checks
+	Timeout time.Duration
+
+	ready  atomic.Bool
+	mu     sync.Mutex
+	checks map[string]Check
+}
+
+func New(timeout time.Duration) *Health {
+	return &Health{
+		Timeout: timeout,
+		checks:  make(map[string]Check),
+	}
+}
+
+// Add adds or replaces the check name.
+func (h *Health) Add(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+// SetReady sets whether the server accepts traffic, regardless of checks.
+func (h *Health) SetReady(ready bool) {
+	h.ready.Store(ready)
+}
+
+func (h *Health) Ready() bool {
+	return h.ready.Load()
+}
+
+// Report is the body of a readiness response.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Check runs every check in parallel. It reports ok only if the server is
+// ready and every check passes.
+func (h *Health) Check(ctx context.Context) (Report, bool) {
+	if !h.Ready() {
+		return Report{Status: "not ready"}, false
+	}
+	h.mu.Lock()
+	names := make([]string, 0, len(h.checks))
+	checks := make([]Check, 0, len(h.checks))
+	for name := range h.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		checks = append(checks, h.checks[name])
+	}
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+	results := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = run(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	r := Report{Status: "ok", Checks: make(map[string]string, len(names))}
+	ok := true
+	for i, name := range names {
+		if err := results[i]; err != nil {
+			r.Checks[name] = err.Error()
+			ok = false
+		} else {
+			r.Checks[name] = "ok"
+		}
+	}
+	if !ok {
+		r.Status = "failing"
+	}
+	return r, ok
+}
+
+// run runs check, giving up when ctx is done even if check does not return.
+func run(ctx context.Context, check Check) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// LiveHandler responds ok as long as the process serves requests.
+func (h *Health) LiveHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(Report{Status: "ok"})
+	}
+}
+
+// ReadyHandler responds 200 when ready and 503 otherwise.
+func (h *Health) ReadyHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		r, ok := h.Check(c.UserContext())
+		if !ok {
+			c.Status(fiber.StatusServiceUnavailable)
+		}
+		return c.JSON(r)
+	}
+}
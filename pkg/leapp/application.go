@@ -1,9 +1,13 @@
 package leapp
 
 import (
+	"context"
+	"fmt"
 	"time"
 
+	"github.com/cloudwindy/mirai/pkg/health"
 	"github.com/cloudwindy/mirai/pkg/lue"
+	"github.com/cloudwindy/mirai/pkg/trace"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
 	"github.com/pkg/errors"
@@ -28,6 +32,8 @@ type Config struct {
 	Start  StartHandler
 	Reload ReloadHandler
 	Stop   StopHandler
+	// readiness checks, app:healthcheck fails if nil
+	Health *health.Health
 }
 
 type Application struct {
@@ -54,37 +60,69 @@ func New(c Config) lue.Module {
 }
 
 var appExports = map[string]lue.Fun{
-	"start":   appStart,
-	"reload":  appReload,
-	"stop":    appStop,
-	"sub":     appSub,
-	"use":     appUse,
-	"add":     appAdd,
-	"all":     appAddMethod(methodAll),
-	"get":     appAddMethod(fiber.MethodGet),
-	"head":    appAddMethod(fiber.MethodHead),
-	"post":    appAddMethod(fiber.MethodPost),
-	"put":     appAddMethod(fiber.MethodPut),
-	"delete":  appAddMethod(fiber.MethodDelete),
-	"connect": appAddMethod(fiber.MethodConnect),
-	"options": appAddMethod(fiber.MethodOptions),
-	"trace":   appAddMethod(fiber.MethodTrace),
-	"patch":   appAddMethod(fiber.MethodPatch),
-	"upgrade": wsAppUpgrade,
+	"start":       appStart,
+	"reload":      appReload,
+	"stop":        appStop,
+	"sub":         appSub,
+	"use":         appUse,
+	"add":         appAdd,
+	"all":         appAddMethod(methodAll),
+	"get":         appAddMethod(fiber.MethodGet),
+	"head":        appAddMethod(fiber.MethodHead),
+	"post":        appAddMethod(fiber.MethodPost),
+	"put":         appAddMethod(fiber.MethodPut),
+	"delete":      appAddMethod(fiber.MethodDelete),
+	"connect":     appAddMethod(fiber.MethodConnect),
+	"options":     appAddMethod(fiber.MethodOptions),
+	"trace":       appAddMethod(fiber.MethodTrace),
+	"patch":       appAddMethod(fiber.MethodPatch),
+	"upgrade":     wsAppUpgrade,
+	"healthcheck": appHealthcheck,
 }
 
 func appHandlerAsync(E *lue.Engine, app *Application, fn *lua.LFunction) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		E, _ := E.New()
 		defer E.Close()
+
+		// handlers called by ctx:next() become children of this span
+		parent := c.UserContext()
+		// database calls of the handler stop if the client leaves
+		ctx, stop := watchClient(parent, c)
+		defer stop()
+		r := c.Route()
+		ctx, span := trace.Start(ctx, "lua "+r.Method+" "+r.Path, trace.KindInternal)
+		defer span.End()
+		c.SetUserContext(ctx)
+		defer c.SetUserContext(parent)
+
+		E.SetContext(WithRequest(ctx, c))
 		env := E.Table(lua.EnvironIndex)
 		if err := E.CallLFun(fn, env, 0, NewContext(E, app, c)); err != nil {
+			span.SetError(err)
 			return errWithStackTrace(err, c)
 		}
 		return nil
 	}
 }
 
+type requestKey struct{}
+
+// WithRequest returns a context carrying the request c. Handlers run with it
+// so that modules can find the request they serve.
+func WithRequest(ctx context.Context, c *fiber.Ctx) context.Context {
+	return context.WithValue(ctx, requestKey{}, c)
+}
+
+// Request returns the request carried by ctx, nil if there is none.
+func Request(ctx context.Context) *fiber.Ctx {
+	if ctx == nil {
+		return nil
+	}
+	c, _ := ctx.Value(requestKey{}).(*fiber.Ctx)
+	return c
+}
+
 func appSub(E *lue.Engine) int {
 	app := E.Data(1).(*Application)
 	prefix := E.String(2)
@@ -199,6 +237,42 @@ func appStop(E *lue.Engine) int {
 	return 0
 }
 
+// appHealthcheck adds a readiness check. The function fails the check by
+// raising an error or returning false and an optional message.
+func appHealthcheck(E *lue.Engine) int {
+	app := E.Data(1).(*Application)
+	name := E.String(2)
+	fn := E.Fun(3)
+	if app.c.Health == nil {
+		E.Error("app healthcheck: health is not enabled")
+	}
+	app.c.Health.Add(name, func(ctx context.Context) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+		}()
+		E, _ := E.New()
+		defer E.Close()
+		E.SetContext(ctx)
+		env := E.Table(lua.EnvironIndex)
+		if err := E.CallLFun(fn, env, 2); err != nil {
+			if lerr, ok := err.(*lua.ApiError); ok {
+				return errors.New(lerr.Object.String())
+			}
+			return err
+		}
+		if lua.LVAsBool(E.Get(1)) {
+			return nil
+		}
+		if msg := E.Get(2); msg != lua.LNil {
+			return errors.New(msg.String())
+		}
+		return errors.New("failed")
+	})
+	return 0
+}
+
 // errWithStackTrace adds a stack trace to the error if it's a Lua error.
 func errWithStackTrace(e error, c *fiber.Ctx) error {
 	if lerr, ok := e.(*lua.ApiError); ok {
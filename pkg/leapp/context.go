@@ -25,8 +25,10 @@ func NewContext(E *lue.Engine, app *Application, fc *fiber.Ctx) lua.LValue {
 
 	index := E.NewTable()
 
+	// empty when the requestid middleware is disabled
+	id, _ := c.Locals("requestid").(string)
 	E.SetDict(index, map[string]string{
-		"id":     c.Locals("requestid").(string),
+		"id":     id,
 		"method": c.Method(),
 		"url":    ctxUrl(c),
 		"path":   c.Path(),
@@ -47,10 +49,11 @@ func NewContext(E *lue.Engine, app *Application, fc *fiber.Ctx) lua.LValue {
 }
 
 var ctxExports = map[string]lue.Fun{
-	"type":  ctxType,
-	"send":  ctxSend,
-	"redir": ctxRedir,
-	"next":  ctxNext,
+	"type":   ctxType,
+	"send":   ctxSend,
+	"redir":  ctxRedir,
+	"next":   ctxNext,
+	"timing": ctxTiming,
 }
 
 func ctxUrl(c *Context) string {
@@ -0,0 +1,105 @@
+package leapp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cloudwindy/mirai/lib/odbc"
+	"github.com/gofiber/fiber/v2"
+)
+
+// DisconnectInterval is how often a handler waiting on the database checks
+// whether its client is still connected.
+var DisconnectInterval = 250 * time.Millisecond
+
+type watchKey struct{}
+
+// watchClient returns parent carrying the client of c for the database
+// calls of the handler, see odbc.Client, and a function that stops
+// watching it once the handler is done. Handlers called by ctx:next()
+// share the client of the first one.
+func watchClient(parent context.Context, c *fiber.Ctx) (context.Context, func()) {
+	if parent.Value(watchKey{}) != nil {
+		return parent, func() {}
+	}
+	w := &clientWatch{c: c}
+	ctx := odbc.WithClient(context.WithValue(parent, watchKey{}, true), w)
+	return ctx, w.stop
+}
+
+// clientWatch watches the connection of a request from the first database
+// call on, so that handlers which never use the database pay nothing.
+type clientWatch struct {
+	c      *fiber.Ctx
+	once   sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Left returns a context that is canceled when the client disconnects or
+// the server shuts down.
+func (w *clientWatch) Left() context.Context {
+	w.once.Do(w.start)
+	return w.ctx
+}
+
+func (w *clientWatch) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.ctx, w.cancel = ctx, cancel
+	conn := w.c.Context().Conn()
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	shutdown := w.c.Context().Done()
+	go func() {
+		t := time.NewTicker(DisconnectInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-shutdown:
+				cancel()
+				return
+			case <-t.C:
+				if hungUp(conn) {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+}
+
+// stop stops the watch, if the handler started it.
+func (w *clientWatch) stop() {
+	w.once.Do(func() {})
+	if w.cancel != nil {
+		w.cancel()
+	}
+}
+
+// hungUp reports whether the peer of conn closed it. Connections that
+// cannot be checked are assumed to be open.
+func hungUp(conn net.Conn) bool {
+	sc, ok := conn.(interface {
+		SyscallConn() (syscall.RawConn, error)
+	})
+	if !ok {
+		return false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	closed := false
+	err = rc.Read(func(fd uintptr) bool {
+		closed = peekEOF(fd)
+		return true
+	})
+	return closed || err != nil
+}
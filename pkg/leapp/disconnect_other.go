@@ -0,0 +1,8 @@
+//go:build !unix
+
+package leapp
+
+// peekEOF is not supported, clients are assumed to stay connected.
+func peekEOF(fd uintptr) bool {
+	return false
+}
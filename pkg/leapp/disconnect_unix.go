@@ -0,0 +1,13 @@
+//go:build unix
+
+package leapp
+
+import "syscall"
+
+// peekEOF reports whether the socket fd reached the end of its input,
+// without reading it or waiting for it.
+func peekEOF(fd uintptr) bool {
+	var b [1]byte
+	n, _, err := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+	return n == 0 && err == nil
+}
@@ -0,0 +1,55 @@
+package leapp
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	lhttp "github.com/cloudwindy/mirai/lib/http"
+	"github.com/cloudwindy/mirai/lib/odbc"
+	"github.com/cloudwindy/mirai/pkg/lue"
+	"github.com/cloudwindy/mirai/pkg/timer"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// TimeDB adds the time of a statement to the db Server-Timing entry of the
+// request running it, see odbc.AddHook.
+func TimeDB(ev odbc.Event) {
+	if c := Request(ev.Context); c != nil {
+		timer.Add(c, "db", "Database", ev.Duration)
+	}
+}
+
+// TimeHTTP adds the time of an outgoing request to the http Server-Timing
+// entry of the request sending it, see the Use function of lib/http.
+func TimeHTTP(req *http.Request, next lhttp.Sender) (*http.Response, error) {
+	c := Request(req.Context())
+	if c == nil {
+		return next(req)
+	}
+	start := time.Now()
+	defer func() {
+		timer.Add(c, "http", "Outbound HTTP", time.Since(start))
+	}()
+	return next(req)
+}
+
+// ctxTiming lua ctx:timing(name, desc) returns a function that stops the
+// Server-Timing entry name. Entries with the same name add up.
+func ctxTiming(E *lue.Engine) int {
+	c := E.Data(1).(*Context)
+	name := E.String(2)
+	if !timer.ValidName(name) {
+		E.L.ArgError(2, "timing name must be a token")
+	}
+	desc := ""
+	if E.Top() > 2 {
+		desc = strings.ReplaceAll(E.String(3), `"`, `'`)
+	}
+	stop := timer.Mark(c.Ctx, name, desc)
+	E.Push(E.L.NewFunction(func(*lua.LState) int {
+		stop()
+		return 0
+	}))
+	return 1
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/cloudwindy/mirai/pkg/lue"
+	"github.com/cloudwindy/mirai/pkg/metrics"
 	"github.com/gofiber/contrib/websocket"
 	"github.com/vadv/gopher-lua-libs/json"
 	lua "github.com/yuin/gopher-lua"
@@ -17,6 +18,8 @@ func wsAppUpgrade(E *lue.Engine) int {
 	fn := E.Fun(3)
 	wsConnHandler := func(c *websocket.Conn) {
 		defer c.Close()
+		metrics.WebSockets.Add(1)
+		defer metrics.WebSockets.Add(-1)
 		E, _ := E.New()
 		defer E.Close()
 		env := E.Table(lua.EnvironIndex)
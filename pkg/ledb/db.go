@@ -1,8 +1,12 @@
 package ledb
 
 import (
+	"context"
+	"database/sql"
 	"os"
 	"path"
+	"sort"
+	"sync/atomic"
 
 	"github.com/cloudwindy/mirai/lib/odbc"
 	"github.com/cloudwindy/mirai/pkg/config"
@@ -10,28 +14,117 @@ import (
 	lua "github.com/yuin/gopher-lua"
 )
 
-func New(c config.DB) lue.Module {
+// New creates the db module, the database of c. The named databases are
+// fields of it, db.<name>, and replicas among them serve db:reader().
+func New(c config.DB, databases map[string]config.DB) lue.Module {
+	names := make([]string, 0, len(databases))
+	for name := range databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// replicas are taken in turn by every state
+	var next atomic.Uint64
 	return func(E *lue.Engine) lua.LValue {
 		odbc.Loader(E.L)
 		E.Clear()
-		dbc := odbc.Config{
-			Driver:     c.Driver,
-			ConnString: c.Conn,
-			Shared:     true,
-		}
-		// open db in protected mode
-		pdb, err := odbc.Open(dbc)
-		if err != nil {
-			E.Error("db open: %v", err)
-		}
 		mt := E.L.NewTypeMetatable("db_ud")
-		index := E.L.GetField(mt, "__index").(*lua.LTable)
-		index.RawSetString("sqlpath", lua.LString(c.SQLPath))
-		E.L.SetFuncs(index, map[string]lua.LGFunction{
+		methods := E.L.GetField(mt, "__index").(*lua.LTable)
+		E.L.SetFuncs(methods, map[string]lua.LGFunction{
 			"loadsql": LoadSQL,
 		})
 
-		return E.Class("db_ud", pdb)
+		index := dbIndex(E, c, methods)
+		db := open(E, c, index)
+		var replicas []lua.LValue
+		for _, name := range names {
+			if methods.RawGetString(name) != lua.LNil {
+				E.Error("db open: database %s has the name of a method of db", name)
+			}
+			ndb := open(E, databases[name], dbIndex(E, databases[name], methods))
+			index.RawSetString(name, ndb)
+			if databases[name].Role == config.RoleReplica {
+				replicas = append(replicas, ndb)
+			}
+		}
+		E.L.SetFuncs(index, map[string]lua.LGFunction{
+			// reader returns a replica, or the database itself without one
+			"reader": func(L *lua.LState) int {
+				if len(replicas) == 0 {
+					L.Push(db)
+					return 1
+				}
+				L.Push(replicas[(next.Add(1)-1)%uint64(len(replicas))])
+				return 1
+			},
+			// writer returns the database itself
+			"writer": func(L *lua.LState) int {
+				L.Push(db)
+				return 1
+			},
+		})
+		return db
+	}
+}
+
+// dbIndex returns the fields of a database, falling back to the methods
+// shared by every database.
+func dbIndex(E *lue.Engine, c config.DB, methods *lua.LTable) *lua.LTable {
+	index := E.NewTable()
+	index.RawSetString("sqlpath", lua.LString(c.SQLPath))
+	mt := E.NewTable()
+	mt.RawSetString("__index", methods)
+	E.L.SetMetatable(index, mt)
+	return index
+}
+
+// open opens the database of c in protected mode.
+func open(E *lue.Engine, c config.DB, index *lua.LTable) lua.LValue {
+	pdb, err := odbc.Open(odbcConfig(c))
+	if err != nil {
+		E.Error("db open: %v", err)
+	}
+	return E.Anonymous(pdb, index)
+}
+
+func odbcConfig(c config.DB) odbc.Config {
+	return odbc.Config{
+		Driver:          c.Driver,
+		ConnString:      c.Conn,
+		Shared:          true,
+		MaxConnections:  c.MaxConnections,
+		MaxIdle:         c.MaxIdle,
+		ConnMaxLifetime: c.ConnMaxLifetime,
+		ConnMaxIdleTime: c.ConnMaxIdleTime,
+		Ping:            c.Ping,
+		Timeout:         c.Timeout,
+		Types:           odbc.Types(c.Types),
+	}
+}
+
+// DB returns the database shared with the db module.
+func DB(c config.DB) (*sql.DB, error) {
+	return odbc.OpenDB(odbcConfig(c))
+}
+
+// Close closes the database shared with the db module.
+func Close(c config.DB) error {
+	return odbc.CloseDB(odbcConfig(c))
+}
+
+// InMemory reports whether the database is an in-memory sqlite database,
+// which each worker has its own of.
+func InMemory(c config.DB) bool {
+	return odbc.InMemory(odbcConfig(c))
+}
+
+// Ping returns a check that the database of the db module is reachable.
+func Ping(c config.DB) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		db, err := DB(c)
+		if err != nil {
+			return err
+		}
+		return db.PingContext(ctx)
 	}
 }
 
@@ -44,10 +137,15 @@ func LoadSQL(L *lua.LState) int {
 	if err != nil {
 		L.RaiseError("db loadfile: %v", err)
 	}
+	// bind arguments are passed on to exec
+	args := []lua.LValue{db, lua.LString(sql)}
+	for i := 3; i <= L.GetTop(); i++ {
+		args = append(args, L.Get(i))
+	}
 	L.Pop(L.GetTop())
 	L.CallByParam(lua.P{
 		Fn:   L.GetField(db, "exec").(*lua.LFunction),
 		NRet: 1,
-	}, db, lua.LString(sql))
+	}, args...)
 	return 1
 }
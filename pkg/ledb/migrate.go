@@ -0,0 +1,321 @@
+package ledb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudwindy/mirai/lib/odbc"
+	"github.com/cloudwindy/mirai/pkg/config"
+	"github.com/cloudwindy/mirai/pkg/lue"
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Migration is a versioned schema change read from
+// <version>_<name>.up.sql and <version>_<name>.down.sql. Either file may be
+// a .lua script instead, which runs with the transaction in the global tx.
+// An sql file is sent as it is, mysql runs files of several statements
+// only with multiStatements=true in the connection string.
+type Migration struct {
+	Version string
+	Name    string
+	// files, Down is empty if the migration cannot be reverted
+	Up, Down string
+	// zero if pending
+	Applied time.Time
+}
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.(sql|lua)$`)
+
+// Migrator applies the migrations of a database.
+type Migrator struct {
+	c   config.DB
+	env map[string]any
+}
+
+// NewMigrator returns a migrator of the database of c. env is the env
+// global of Lua migrations.
+func NewMigrator(c config.DB, env map[string]any) *Migrator {
+	return &Migrator{c: c, env: env}
+}
+
+// Load reads the migrations from the migrations directory, in order.
+func (m *Migrator) Load() ([]Migration, error) {
+	entries, err := os.ReadDir(m.c.Migrations.Path)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[string]*Migration)
+	for _, e := range entries {
+		match := migrationFile.FindStringSubmatch(e.Name())
+		if e.IsDir() || match == nil {
+			continue
+		}
+		version, name, dir := match[1], match[2], match[3]
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: name}
+			byVersion[version] = mig
+		}
+		if mig.Name != name {
+			return nil, fmt.Errorf("migration %s is named both %s and %s", version, mig.Name, name)
+		}
+		file := filepath.Join(m.c.Migrations.Path, e.Name())
+		target := &mig.Up
+		if dir == "down" {
+			target = &mig.Down
+		}
+		if *target != "" {
+			return nil, fmt.Errorf("migration %s has both %s and %s", version, *target, file)
+		}
+		*target = file
+	}
+	migs := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %s_%s has no up file", mig.Version, mig.Name)
+		}
+		migs = append(migs, *mig)
+	}
+	sort.Slice(migs, func(i, j int) bool {
+		return versionLess(migs[i].Version, migs[j].Version)
+	})
+	return migs, nil
+}
+
+// versionLess compares versions as numbers.
+func versionLess(a, b string) bool {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// Status returns the migrations with the time they were applied.
+// Applied versions without files are included with only a version.
+func (m *Migrator) Status() ([]Migration, error) {
+	db, err := DB(m.c)
+	if err != nil {
+		return nil, err
+	}
+	migs, err := m.Load()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(db)
+	if err != nil {
+		return nil, err
+	}
+	for i := range migs {
+		migs[i].Applied = applied[migs[i].Version]
+		delete(applied, migs[i].Version)
+	}
+	for version, at := range applied {
+		migs = append(migs, Migration{Version: version, Applied: at})
+	}
+	sort.SliceStable(migs, func(i, j int) bool {
+		return versionLess(migs[i].Version, migs[j].Version)
+	})
+	return migs, nil
+}
+
+// Up applies up to n pending migrations, all of them if n is 0, in one
+// transaction. It returns the migrations applied. mysql commits schema
+// changes implicitly, so there a failed migration keeps the changes of
+// the statements before it.
+func (m *Migrator) Up(ctx context.Context, n int) ([]Migration, error) {
+	migs, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, mig := range migs {
+		if mig.Applied.IsZero() && (n == 0 || len(pending) < n) {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, m.apply(ctx, pending, true)
+}
+
+// Down reverts the last n applied migrations in one transaction. It
+// returns the migrations reverted.
+func (m *Migrator) Down(ctx context.Context, n int) ([]Migration, error) {
+	migs, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+	var applied []Migration
+	for i := len(migs) - 1; i >= 0 && len(applied) < n; i-- {
+		if mig := migs[i]; !mig.Applied.IsZero() {
+			if mig.Up == "" {
+				return nil, fmt.Errorf("migration %s is applied but its files are missing", mig.Version)
+			}
+			if mig.Down == "" {
+				return nil, fmt.Errorf("migration %s_%s cannot be reverted, it has no down file", mig.Version, mig.Name)
+			}
+			applied = append(applied, mig)
+		}
+	}
+	return applied, m.apply(ctx, applied, false)
+}
+
+func (m *Migrator) apply(ctx context.Context, migs []Migration, up bool) error {
+	if len(migs) == 0 {
+		return nil
+	}
+	for _, mig := range migs {
+		if filepath.Ext(mig.Up) == ".sql" || filepath.Ext(mig.Down) == ".sql" {
+			if err := m.checkConn(); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	db, err := DB(m.c)
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	table := m.c.Migrations.Table
+	for _, mig := range migs {
+		file, record, args := mig.Up, "INSERT INTO "+table+" (version, name, applied_at) VALUES (?, ?, ?)",
+			[]any{mig.Version, mig.Name, time.Now().UTC().Format(time.RFC3339)}
+		if !up {
+			file, record, args = mig.Down, "DELETE FROM "+table+" WHERE version = ?", []any{mig.Version}
+		}
+		if err := m.run(ctx, tx, file); err != nil {
+			return errors.Wrapf(err, "migration %s_%s", mig.Version, mig.Name)
+		}
+		record, err := odbc.Rebind(m.c.Driver, record)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// run runs a migration file in tx.
+func (m *Migrator) run(ctx context.Context, tx *sql.Tx, file string) error {
+	if filepath.Ext(file) == ".lua" {
+		G := lue.New(m.env)
+		defer G.Close()
+		G.SetContext(ctx)
+		return G.Register("tx", func(E *lue.Engine) lua.LValue {
+			odbc.Loader(E.L)
+			E.Clear()
+			return odbc.NewTx(E.L, tx, m.c.Driver)
+		}).Run(file).Err()
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, string(b))
+	return err
+}
+
+// checkConn refuses to run sql files on mysql without multiStatements,
+// which would fail on files of several statements halfway.
+func (m *Migrator) checkConn() error {
+	if m.c.Driver != "mysql" {
+		return nil
+	}
+	dsn, err := mysql.ParseDSN(m.c.Conn)
+	if err != nil {
+		return err
+	}
+	if !dsn.MultiStatements {
+		return errors.New("mysql migrations need multiStatements=true in db.conn")
+	}
+	return nil
+}
+
+// applied returns the applied versions, creating the history table if
+// it does not exist.
+func (m *Migrator) applied(db *sql.DB) (map[string]time.Time, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS " + m.c.Migrations.Table + ` (
+	version VARCHAR(32) PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	applied_at VARCHAR(32) NOT NULL
+)`)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version, applied_at FROM " + m.c.Migrations.Table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[string]time.Time)
+	for rows.Next() {
+		var version, at string
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			// applied at an unknown time
+			t = time.Unix(0, 0)
+		}
+		applied[version] = t
+	}
+	return applied, rows.Err()
+}
+
+// CreateMigration writes empty up and down files for a new migration
+// named name, versioned by the current time, and returns their paths.
+func CreateMigration(c config.DB, name string, script bool) ([]string, error) {
+	name = strings.Trim(regexp.MustCompile(`\W+`).ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if name == "" {
+		return nil, errors.New("migration name is empty")
+	}
+	if err := os.MkdirAll(c.Migrations.Path, 0o755); err != nil {
+		return nil, err
+	}
+	ext := ".sql"
+	if script {
+		ext = ".lua"
+	}
+	version := time.Now().UTC().Format("20060102150405")
+	entries, err := os.ReadDir(c.Migrations.Path)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		// keep versions unique and ordered when created within a second
+		if match := migrationFile.FindStringSubmatch(e.Name()); match != nil && !versionLess(match[1], version) {
+			n, _ := strconv.ParseUint(match[1], 10, 64)
+			version = strconv.FormatUint(n+1, 10)
+		}
+	}
+	var files []string
+	for _, dir := range []string{"up", "down"} {
+		file := filepath.Join(c.Migrations.Path, version+"_"+name+"."+dir+ext)
+		body := fmt.Sprintf("-- %s: %s\n", dir, name)
+		if script {
+			body += "-- tx:exec(...) runs in the migration transaction\n"
+		}
+		if err := os.WriteFile(file, []byte(body), 0o644); err != nil {
+			return files, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
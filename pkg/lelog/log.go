@@ -0,0 +1,57 @@
+package lelog
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/cloudwindy/mirai/pkg/leapp"
+	"github.com/cloudwindy/mirai/pkg/logging"
+	"github.com/cloudwindy/mirai/pkg/lue"
+	"github.com/yuin/gluamapper"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// New creates the log module. Records logged while serving a request carry
+// its request id, route and user.
+func New(l *logging.Logger) lue.Module {
+	return func(E *lue.Engine) lua.LValue {
+		log := E.NewTable()
+		// handlers share the functions of the main state, so the calling
+		// state is used to find the request
+		E.L.SetFuncs(log, map[string]lua.LGFunction{
+			"debug": logLevel(l, slog.LevelDebug),
+			"info":  logLevel(l, slog.LevelInfo),
+			"warn":  logLevel(l, slog.LevelWarn),
+			"error": logLevel(l, slog.LevelError),
+		})
+		return log
+	}
+}
+
+// logLevel logs msg with the fields of an optional table.
+func logLevel(l *logging.Logger, level slog.Level) lua.LGFunction {
+	return func(L *lua.LState) int {
+		msg := L.CheckString(1)
+		ctx := L.Context()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		logger := l.Logger
+		if c := leapp.Request(ctx); c != nil {
+			logger = l.Request(c)
+		}
+		if !logger.Enabled(ctx, level) {
+			return 0
+		}
+		var fields []any
+		if t, ok := L.Get(2).(*lua.LTable); ok {
+			t.ForEach(func(k, v lua.LValue) {
+				fields = append(fields, k.String(), gluamapper.ToGoValue(v, gluamapper.Option{
+					NameFunc: func(s string) string { return s },
+				}))
+			})
+		}
+		logger.Log(ctx, level, msg, fields...)
+		return 0
+	}
+}
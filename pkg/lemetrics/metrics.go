@@ -0,0 +1,130 @@
+package lemetrics
+
+import (
+	"github.com/cloudwindy/mirai/pkg/lue"
+	"github.com/cloudwindy/mirai/pkg/metrics"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const LTMetric = "Metric"
+
+// New creates the metrics module, which defines custom metrics in the
+// default registry. Defining a metric again returns the existing one, so
+// scripts may run more than once.
+func New() lue.Module {
+	return func(E *lue.Engine) lua.LValue {
+		mt := E.L.NewTypeMetatable(LTMetric)
+		// handlers share the functions of the main state, so the calling
+		// state is used
+		E.L.SetField(mt, "__index", E.L.SetFuncs(E.L.NewTable(), map[string]lua.LGFunction{
+			"inc":     metricInc,
+			"dec":     metricDec,
+			"add":     metricAdd,
+			"set":     metricSet,
+			"observe": metricObserve,
+		}))
+		m := E.NewTable()
+		E.L.SetFuncs(m, map[string]lua.LGFunction{
+			"counter":   define(metrics.TypeCounter),
+			"gauge":     define(metrics.TypeGauge),
+			"histogram": define(metrics.TypeHistogram),
+		})
+		return m
+	}
+}
+
+// define registers a metric: metrics.counter(name, help, labels) and
+// metrics.histogram(name, help, labels, buckets).
+func define(typ string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		m := &metrics.Metric{
+			Name: L.CheckString(1),
+			Help: L.OptString(2, ""),
+			Type: typ,
+		}
+		if t := L.OptTable(3, nil); t != nil {
+			t.ForEach(func(_, v lua.LValue) {
+				m.Labels = append(m.Labels, lua.LVAsString(v))
+			})
+		}
+		if t := L.OptTable(4, nil); t != nil {
+			t.ForEach(func(_, v lua.LValue) {
+				m.Buckets = append(m.Buckets, float64(lua.LVAsNumber(v)))
+			})
+		}
+		m, err := metrics.Default.Register(m)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		ud := L.NewUserData()
+		ud.Value = m
+		L.SetMetatable(ud, L.GetTypeMetatable(LTMetric))
+		L.Push(ud)
+		return 1
+	}
+}
+
+func checkMetric(L *lua.LState) *metrics.Metric {
+	m, ok := L.CheckUserData(1).Value.(*metrics.Metric)
+	if !ok {
+		L.ArgError(1, "metric expected")
+	}
+	return m
+}
+
+// labelValues reads label values from a table, either by label name or in
+// order. Missing labels are empty.
+func labelValues(L *lua.LState, m *metrics.Metric, n int) []string {
+	t := L.OptTable(n, nil)
+	values := make([]string, len(m.Labels))
+	if t == nil {
+		return values
+	}
+	for i, name := range m.Labels {
+		v := t.RawGetString(name)
+		if v == lua.LNil {
+			v = t.RawGetInt(i + 1)
+		}
+		if v != lua.LNil {
+			values[i] = lua.LVAsString(v)
+		}
+	}
+	return values
+}
+
+func update(L *lua.LState, err error) int {
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	return 0
+}
+
+// metricInc lua metric:inc(labels)
+func metricInc(L *lua.LState) int {
+	m := checkMetric(L)
+	return update(L, m.Add(1, labelValues(L, m, 2)...))
+}
+
+// metricDec lua metric:dec(labels)
+func metricDec(L *lua.LState) int {
+	m := checkMetric(L)
+	return update(L, m.Add(-1, labelValues(L, m, 2)...))
+}
+
+// metricAdd lua metric:add(value, labels)
+func metricAdd(L *lua.LState) int {
+	m := checkMetric(L)
+	return update(L, m.Add(float64(L.CheckNumber(2)), labelValues(L, m, 3)...))
+}
+
+// metricSet lua metric:set(value, labels)
+func metricSet(L *lua.LState) int {
+	m := checkMetric(L)
+	return update(L, m.Set(float64(L.CheckNumber(2)), labelValues(L, m, 3)...))
+}
+
+// metricObserve lua metric:observe(value, labels)
+func metricObserve(L *lua.LState) int {
+	m := checkMetric(L)
+	return update(L, m.Observe(float64(L.CheckNumber(2)), labelValues(L, m, 3)...))
+}
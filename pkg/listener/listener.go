@@ -0,0 +1,150 @@
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/cloudwindy/mirai/pkg/config"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Open opens a socket for each listener.
+func Open(cs []config.Listener) ([]net.Listener, error) {
+	lns := make([]net.Listener, 0, len(cs))
+	for _, c := range cs {
+		ln, err := open(c)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+func open(c config.Listener) (net.Listener, error) {
+	switch c.Type {
+	case config.ListenHTTP, config.ListenHTTPS, config.ListenRedirect:
+		return net.Listen("tcp", c.Listen)
+	case config.ListenUnix:
+		// remove the socket left behind by an unclean exit
+		if info, err := os.Stat(c.Listen); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(c.Listen)
+		}
+		return net.Listen("unix", c.Listen)
+	}
+	return nil, fmt.Errorf("listener %s: unknown type %q", c.Listen, c.Type)
+}
+
+// Check reports whether inherited sockets still match the listeners, which
+// may have been changed before a reload.
+func Check(cs []config.Listener, lns []net.Listener) error {
+	if len(cs) != len(lns) {
+		return errors.New("listeners changed, restart required")
+	}
+	for i, c := range cs {
+		network := "tcp"
+		if c.Type == config.ListenUnix {
+			network = "unix"
+		}
+		if lns[i].Addr().Network() != network {
+			return fmt.Errorf("listener %s changed, restart required", c.Listen)
+		}
+	}
+	return nil
+}
+
+// Server serves an app on a set of listeners.
+type Server struct {
+	App       *fiber.App
+	Listeners []config.Listener
+	// called when a listener stops with an error
+	OnError func(error)
+	// verify client certificates on https listeners, clients without one
+	// are still accepted
+	ClientCAs *x509.CertPool
+
+	redirects []*fiber.App
+}
+
+// Serve starts serving lns in the background. Certificates are loaded
+// before it returns.
+func (s *Server) Serve(lns []net.Listener) error {
+	if err := Check(s.Listeners, lns); err != nil {
+		return err
+	}
+	type serve struct {
+		app *fiber.App
+		ln  net.Listener
+	}
+	serves := make([]serve, len(lns))
+	for i, c := range s.Listeners {
+		ln := lns[i]
+		app := s.App
+		switch c.Type {
+		case config.ListenHTTPS:
+			certs, err := newCertStore(c)
+			if err != nil {
+				return err
+			}
+			tc := &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: certs.get,
+			}
+			if s.ClientCAs != nil {
+				tc.ClientAuth = tls.VerifyClientCertIfGiven
+				tc.ClientCAs = s.ClientCAs
+			}
+			ln = tls.NewListener(ln, tc)
+		case config.ListenRedirect:
+			app = redirectApp(c.To)
+			s.redirects = append(s.redirects, app)
+		}
+		serves[i] = serve{app, ln}
+	}
+	for _, sv := range serves {
+		go func(app *fiber.App, ln net.Listener) {
+			if err := app.Listener(ln); err != nil && s.OnError != nil {
+				s.OnError(err)
+			}
+		}(sv.app, sv.ln)
+	}
+	return nil
+}
+
+// Shutdown stops the redirect servers. The app is shut down by its owner.
+func (s *Server) Shutdown() error {
+	var errs []error
+	for _, app := range s.redirects {
+		errs = append(errs, app.Shutdown())
+	}
+	return errors.Join(errs...)
+}
+
+// redirectApp redirects every request to https, on the host to or on the
+// requested host.
+func redirectApp(to string) *fiber.App {
+	app := fiber.New(fiber.Config{
+		DisableStartupMessage: true,
+	})
+	to = strings.TrimSuffix(to, "/")
+	app.Use(func(c *fiber.Ctx) error {
+		target := to
+		if target == "" {
+			host := c.Hostname()
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			target = "https://" + host
+		}
+		return c.Redirect(target+c.OriginalURL(), fiber.StatusMovedPermanently)
+	})
+	return app
+}
@@ -0,0 +1,106 @@
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cloudwindy/mirai/pkg/config"
+)
+
+// How often certificate files are checked for changes.
+var CertCheckInterval = 10 * time.Second
+
+// certStore holds the certificates of a listener and reloads them when
+// their files change.
+type certStore struct {
+	mu    sync.Mutex
+	certs []*certFile
+}
+
+type certFile struct {
+	config.Cert
+	mod     time.Time
+	checked time.Time
+	cert    *tls.Certificate
+}
+
+func newCertStore(c config.Listener) (*certStore, error) {
+	var files []config.Cert
+	if c.Cert != "" || c.Key != "" {
+		files = append(files, config.Cert{Cert: c.Cert, Key: c.Key})
+	}
+	files = append(files, c.Certs...)
+	if len(files) == 0 {
+		return nil, errors.New("listener " + c.Listen + ": https requires cert and key")
+	}
+	s := new(certStore)
+	for _, f := range files {
+		cf := &certFile{Cert: f}
+		if err := cf.load(); err != nil {
+			return nil, err
+		}
+		s.certs = append(s.certs, cf)
+	}
+	return s, nil
+}
+
+// get picks a certificate by SNI, falling back to the first one.
+func (s *certStore) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cf := range s.certs {
+		cf.reload()
+	}
+	for _, cf := range s.certs {
+		if hello.SupportsCertificate(cf.cert) == nil {
+			return cf.cert, nil
+		}
+	}
+	return s.certs[0].cert, nil
+}
+
+func (cf *certFile) load() error {
+	info, err := os.Stat(cf.Cert.Cert)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cf.Cert.Cert, cf.Key)
+	if err != nil {
+		return err
+	}
+	cf.cert = &cert
+	cf.mod = info.ModTime()
+	cf.checked = time.Now()
+	return nil
+}
+
+// reload loads the certificate again if the file has changed. A broken
+// certificate is ignored and the previous one is kept.
+func (cf *certFile) reload() {
+	if time.Since(cf.checked) < CertCheckInterval {
+		return
+	}
+	cf.checked = time.Now()
+	info, err := os.Stat(cf.Cert.Cert)
+	if err != nil || info.ModTime().Equal(cf.mod) {
+		return
+	}
+	cf.load()
+}
+
+// LoadClientCAs loads the PEM certificates in file to verify clients with.
+func LoadClientCAs(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("client ca " + file + ": no certificates found")
+	}
+	return pool, nil
+}
@@ -0,0 +1,146 @@
+// Package logging writes structured application and access logs.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/cloudwindy/mirai/lib/odbc"
+	"github.com/cloudwindy/mirai/pkg/config"
+	"github.com/cloudwindy/mirai/pkg/leapp"
+	"github.com/cloudwindy/mirai/pkg/trace"
+	"github.com/gofiber/fiber/v2"
+	lua "github.com/yuin/gopher-lua"
+)
+
+type Logger struct {
+	*slog.Logger
+	// text, json or logfmt
+	Format string
+	// where records are written
+	Output io.Writer
+}
+
+var levels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// New creates the logger described by c.
+func New(c config.Log) (*Logger, error) {
+	l := &Logger{
+		Format: c.Format,
+		Output: os.Stdout,
+	}
+	if c.File != "" {
+		w, err := openRotate(c.File, int64(c.MaxSize)<<20, c.MaxFiles)
+		if err != nil {
+			return nil, err
+		}
+		l.Output = w
+	}
+	opts := &slog.HandlerOptions{
+		Level: levels[c.Level],
+	}
+	if c.Format == config.LogJSON {
+		l.Logger = slog.New(slog.NewJSONHandler(l.Output, opts))
+	} else {
+		l.Logger = slog.New(slog.NewTextHandler(l.Output, opts))
+	}
+	return l, nil
+}
+
+// Close closes the log file.
+func (l *Logger) Close() error {
+	if c, ok := l.Output.(io.Closer); ok && l.Output != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+// Request returns a logger with the fields of the request c.
+func (l *Logger) Request(c *fiber.Ctx) *slog.Logger {
+	return l.With(Fields(c)...)
+}
+
+// Fields returns the request id, trace id, route and user of c. The user
+// is taken from ctx.state.user.
+func Fields(c *fiber.Ctx) []any {
+	var fields []any
+	if span := trace.SpanFromContext(c.UserContext()); span != nil {
+		fields = append(fields, "trace_id", span.TraceID.String())
+	}
+	if id, ok := c.Locals("requestid").(string); ok {
+		fields = append(fields, "request_id", id)
+	}
+	if r := c.Route(); r != nil {
+		fields = append(fields, "route", r.Path)
+	}
+	if u, ok := c.Locals("user").(lua.LValue); ok && u != lua.LNil {
+		fields = append(fields, "user", u.String())
+	}
+	return fields
+}
+
+// SlowQueries returns a hook logging the database statements that take
+// longer than threshold, with the fields of the request running them, see
+// odbc.AddHook.
+func (l *Logger) SlowQueries(threshold time.Duration) func(odbc.Event) {
+	return func(ev odbc.Event) {
+		if ev.Duration < threshold {
+			return
+		}
+		ctx, log := ev.Context, l.Logger
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		if c := leapp.Request(ctx); c != nil {
+			log = l.Request(c)
+		}
+		attrs := []any{
+			"op", ev.Op,
+			"query", ev.Query,
+			"args", ev.Args,
+			"duration_ms", float64(ev.Duration.Microseconds()) / 1000,
+		}
+		if ev.Rows >= 0 {
+			attrs = append(attrs, "rows", ev.Rows)
+		}
+		if ev.Err != nil {
+			attrs = append(attrs, "error", ev.Err.Error())
+		}
+		log.Log(ctx, slog.LevelWarn, "slow query", attrs...)
+	}
+}
+
+// Access logs a record for every request.
+func (l *Logger) Access() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		if err := c.Next(); err != nil {
+			// let the error handler set the status before logging it
+			if err := c.App().ErrorHandler(c, err); err != nil {
+				c.Status(fiber.StatusInternalServerError)
+			}
+		}
+		status := c.Response().StatusCode()
+		level := slog.LevelInfo
+		if status >= fiber.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		l.Request(c).Log(c.UserContext(), level, "request",
+			"method", c.Method(),
+			"path", c.Path(),
+			"status", status,
+			"latency_ms", float64(time.Since(start).Microseconds())/1000,
+			"ip", c.IP(),
+			"bytes", len(c.Response().Body()),
+		)
+		return nil
+	}
+}
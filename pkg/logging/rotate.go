@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotateWriter appends to a file and rotates it once it grows past
+// maxSize. Workers share the file: a worker that finds the file rotated by
+// another one reopens it instead of rotating again.
+type rotateWriter struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+}
+
+func openRotate(path string, maxSize int64, maxFiles int) (*rotateWriter, error) {
+	w := &rotateWriter{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotateWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	return nil
+}
+
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.maxSize > 0 {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	return w.file.Write(p)
+}
+
+func (w *rotateWriter) rotate() error {
+	cur, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(w.path)
+	if err == nil && !os.SameFile(cur, info) {
+		// rotated by another worker
+		w.file.Close()
+		return w.open()
+	}
+	if cur.Size() < w.maxSize {
+		return nil
+	}
+	w.file.Close()
+	os.Remove(w.name(w.maxFiles))
+	for i := w.maxFiles - 1; i > 0; i-- {
+		os.Rename(w.name(i), w.name(i+1))
+	}
+	if err := os.Rename(w.path, w.name(1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return w.open()
+}
+
+// name returns the path of the i-th rotated file.
+func (w *rotateWriter) name(i int) string {
+	return fmt.Sprintf("%s.%d", w.path, i)
+}
+
+func (w *rotateWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
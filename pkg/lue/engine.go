@@ -96,6 +96,7 @@ func (e *Engine) New() (E *Engine, new bool) {
 
 func (e *Engine) Close() {
 	if e.parent != nil {
+		e.L.RemoveContext()
 		e.lsp.Put(e.L)
 		return
 	}
@@ -163,6 +164,22 @@ func (e *Engine) EvalWithContext(ctx context.Context, str string) *Engine {
 	return e
 }
 
+// SetContext sets the context of the state, a child engine drops it when
+// closed.
+func (e *Engine) SetContext(ctx context.Context) {
+	e.L.SetContext(ctx)
+}
+
+// Context returns the context of the state, nil if none is set.
+func (e *Engine) Context() context.Context {
+	return e.L.Context()
+}
+
+// PoolStats reports the states pooled for child engines.
+func (e *Engine) PoolStats() lutpool.Stats {
+	return e.lsp.Stats()
+}
+
 func (e *Engine) Err() error {
 	return e.err
 }
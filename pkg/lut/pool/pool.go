@@ -9,9 +9,19 @@ import (
 type LSPool struct {
 	m       sync.Mutex
 	options lua.Options
+	created int
 	Saved   []*lua.LState
 }
 
+type Stats struct {
+	// states created so far
+	Created int `json:"created"`
+	// states waiting in the pool
+	Idle int `json:"idle"`
+	// states currently in use
+	Busy int `json:"busy"`
+}
+
 func New(opt ...lua.Options) *LSPool {
 	pool := new(LSPool)
 	if len(opt) > 0 {
@@ -25,6 +35,7 @@ func (pl *LSPool) Get() (L *lua.LState, new bool) {
 	defer pl.m.Unlock()
 	n := len(pl.Saved)
 	if n == 0 {
+		pl.created++
 		return pl.New(), true
 	}
 	x := pl.Saved[n-1]
@@ -42,6 +53,16 @@ func (pl *LSPool) Put(L *lua.LState) {
 	pl.Saved = append(pl.Saved, L)
 }
 
+func (pl *LSPool) Stats() Stats {
+	pl.m.Lock()
+	defer pl.m.Unlock()
+	return Stats{
+		Created: pl.created,
+		Idle:    len(pl.Saved),
+		Busy:    pl.created - len(pl.Saved),
+	}
+}
+
 func (pl *LSPool) Close() {
 	for _, L := range pl.Saved {
 		L.Close()
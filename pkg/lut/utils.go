@@ -3,6 +3,7 @@ package lut
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 
 	lua "github.com/yuin/gopher-lua"
@@ -10,25 +11,37 @@ import (
 )
 
 // CompileLua reads the passed lua file from disk and compiles it.
+// Assignments to global variables are rejected.
 func CompileLua(filePath string) (*lua.FunctionProto, error) {
-	file, err := os.Open(filePath)
+	proto, err := ParseLua(filePath)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	reader := bufio.NewReader(file)
-	chunk, err := parse.Parse(reader, filePath)
-	if err != nil {
+	if err := CheckGlobal(proto, filePath); err != nil {
 		return nil, err
 	}
-	proto, err := lua.Compile(chunk, filePath)
+	return proto, nil
+}
+
+// ParseLua reads the passed lua file from disk and compiles it without
+// further checks.
+func ParseLua(filePath string) (*lua.FunctionProto, error) {
+	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, err
 	}
-	if err := CheckGlobal(proto, filePath); err != nil {
+	defer file.Close()
+	return ParseLuaSource(bufio.NewReader(file), filePath)
+}
+
+// ParseLuaSource compiles the lua source read from r, name is used in
+// error messages.
+func ParseLuaSource(r io.Reader, name string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(r, name)
+	if err != nil {
 		return nil, err
 	}
-	return proto, nil
+	return lua.Compile(chunk, name)
 }
 
 func DoCompiledFile(L *lua.LState, proto *lua.FunctionProto) error {
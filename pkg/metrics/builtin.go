@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/cloudwindy/mirai/lib/odbc"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Built-in metrics
+var (
+	HTTPRequests = Default.MustRegister(&Metric{
+		Name:   "mirai_http_requests_total",
+		Help:   "HTTP requests served.",
+		Type:   TypeCounter,
+		Labels: []string{"method", "route", "status"},
+	})
+	HTTPDuration = Default.MustRegister(&Metric{
+		Name:   "mirai_http_request_duration_seconds",
+		Help:   "Time spent serving HTTP requests.",
+		Type:   TypeHistogram,
+		Labels: []string{"method", "route", "status"},
+	})
+	DBDuration = Default.MustRegister(&Metric{
+		Name:   "mirai_db_query_duration_seconds",
+		Help:   "Time spent running database statements.",
+		Type:   TypeHistogram,
+		Labels: []string{"op", "error"},
+	})
+	LuaStates = Default.MustRegister(&Metric{
+		Name:   "mirai_lua_pool_states",
+		Help:   "Lua states pooled for handlers.",
+		Type:   TypeGauge,
+		Labels: []string{"state"},
+	})
+	WebSockets = Default.MustRegister(&Metric{
+		Name: "mirai_websocket_connections",
+		Help: "Open WebSocket connections.",
+		Type: TypeGauge,
+	})
+)
+
+func init() {
+	WebSockets.Set(0)
+}
+
+// Middleware counts requests and their latency by route and status.
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+		status := c.Response().StatusCode()
+		if err != nil {
+			// the error handler has not run yet
+			status = fiber.StatusInternalServerError
+			var ferr *fiber.Error
+			if errors.As(err, &ferr) {
+				status = ferr.Code
+			}
+		}
+		route := ""
+		if r := c.Route(); r != nil {
+			route = r.Path
+		}
+		code := strconv.Itoa(status)
+		HTTPRequests.Add(1, c.Method(), route, code)
+		HTTPDuration.Observe(time.Since(start).Seconds(), c.Method(), route, code)
+		return err
+	}
+}
+
+// ObserveDB records a database statement, see odbc.AddHook.
+func ObserveDB(ev odbc.Event) {
+	DBDuration.Observe(ev.Duration.Seconds(), ev.Op, strconv.FormatBool(ev.Err != nil))
+}
+
+// Handler serves the default registry.
+func Handler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+		return Default.Write(c)
+	}
+}
@@ -0,0 +1,283 @@
+// Package metrics keeps counters, gauges and histograms and writes them in
+// the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// DefBuckets are the histogram buckets in seconds used when none are given.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var validName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Registry holds a set of metrics.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*Metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]*Metric),
+	}
+}
+
+// Default is the registry served by Handler.
+var Default = NewRegistry()
+
+// Metric is a family of series of one type, one series per combination of
+// label values.
+type Metric struct {
+	Name    string
+	Help    string
+	Type    string
+	Labels  []string
+	Buckets []float64
+	// called before the metric is written
+	Collect func(m *Metric)
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+// Register adds a metric. Registering a metric again with the same type and
+// labels returns the existing one.
+func (r *Registry) Register(m *Metric) (*Metric, error) {
+	if !validName.MatchString(m.Name) {
+		return nil, fmt.Errorf("invalid metric name %q", m.Name)
+	}
+	for _, l := range m.Labels {
+		if !validName.MatchString(l) || strings.HasPrefix(l, "__") {
+			return nil, fmt.Errorf("metric %s: invalid label %q", m.Name, l)
+		}
+	}
+	switch m.Type {
+	case TypeCounter, TypeGauge:
+	case TypeHistogram:
+		if len(m.Buckets) == 0 {
+			m.Buckets = DefBuckets
+		}
+		if !sort.Float64sAreSorted(m.Buckets) {
+			return nil, fmt.Errorf("metric %s: buckets must be sorted", m.Name)
+		}
+	default:
+		return nil, fmt.Errorf("metric %s: unknown type %q", m.Name, m.Type)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.metrics[m.Name]; ok {
+		if old.Type != m.Type || strings.Join(old.Labels, ",") != strings.Join(m.Labels, ",") {
+			return nil, fmt.Errorf("metric %s already registered as %s with labels %v", m.Name, old.Type, old.Labels)
+		}
+		return old, nil
+	}
+	m.series = make(map[string]*series)
+	r.metrics[m.Name] = m
+	return m, nil
+}
+
+// MustRegister is like Register but panics on error.
+func (r *Registry) MustRegister(m *Metric) *Metric {
+	m, err := r.Register(m)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// get returns the series for the label values, creating it if needed.
+// The caller holds m.mu.
+func (m *Metric) get(values []string) (*series, error) {
+	if len(values) != len(m.Labels) {
+		return nil, fmt.Errorf("metric %s: expected %d label values, got %d", m.Name, len(m.Labels), len(values))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{values: make([]string, len(values))}
+		for i, v := range values {
+			// values may point into request buffers
+			s.values[i] = strings.Clone(v)
+		}
+		if m.Type == TypeHistogram {
+			s.counts = make([]uint64, len(m.Buckets))
+		}
+		m.series[key] = s
+	}
+	return s, nil
+}
+
+// Add adds v to a counter or gauge. Counters only go up.
+func (m *Metric) Add(v float64, values ...string) error {
+	switch {
+	case m.Type == TypeHistogram:
+		return fmt.Errorf("metric %s: cannot add to a histogram", m.Name)
+	case m.Type == TypeCounter && v < 0:
+		return fmt.Errorf("metric %s: counters cannot decrease", m.Name)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, err := m.get(values)
+	if err != nil {
+		return err
+	}
+	s.value += v
+	return nil
+}
+
+// Set sets a gauge.
+func (m *Metric) Set(v float64, values ...string) error {
+	if m.Type != TypeGauge {
+		return fmt.Errorf("metric %s: only gauges can be set", m.Name)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, err := m.get(values)
+	if err != nil {
+		return err
+	}
+	s.value = v
+	return nil
+}
+
+// Observe records v in a histogram.
+func (m *Metric) Observe(v float64, values ...string) error {
+	if m.Type != TypeHistogram {
+		return fmt.Errorf("metric %s: only histograms can observe", m.Name)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, err := m.get(values)
+	if err != nil {
+		return err
+	}
+	for i, b := range m.Buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+	return nil
+}
+
+// Write writes every metric in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := make([]*Metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	r.mu.Unlock()
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Name < metrics[j].Name
+	})
+
+	b := new(strings.Builder)
+	for _, m := range metrics {
+		if m.Collect != nil {
+			m.Collect(m)
+		}
+		m.write(b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (m *Metric) write(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.series) == 0 {
+		return
+	}
+	if m.Help != "" {
+		fmt.Fprintf(b, "# HELP %s %s\n", m.Name, escapeHelp(m.Help))
+	}
+	fmt.Fprintf(b, "# TYPE %s %s\n", m.Name, m.Type)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.Type != TypeHistogram {
+			writeSample(b, m.Name, m.Labels, s.values, "", "", s.value)
+			continue
+		}
+		for i, le := range m.Buckets {
+			writeSample(b, m.Name+"_bucket", m.Labels, s.values, "le", formatFloat(le), float64(s.counts[i]))
+		}
+		writeSample(b, m.Name+"_bucket", m.Labels, s.values, "le", "+Inf", float64(s.count))
+		writeSample(b, m.Name+"_sum", m.Labels, s.values, "", "", s.value)
+		writeSample(b, m.Name+"_count", m.Labels, s.values, "", "", float64(s.count))
+	}
+}
+
+func writeSample(b *strings.Builder, name string, labels, values []string, extra, extraValue string, v float64) {
+	b.WriteString(name)
+	if len(labels) > 0 || extra != "" {
+		b.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "%s=\"%s\"", l, escapeLabel(values[i]))
+		}
+		if extra != "" {
+			if len(labels) > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "%s=\"%s\"", extra, extraValue)
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(v))
+	b.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
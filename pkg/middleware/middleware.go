@@ -0,0 +1,119 @@
+// Package middleware builds the built-in middleware configured in the
+// middleware section of the manifest.
+package middleware
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloudwindy/mirai/pkg/config"
+	"github.com/cloudwindy/mirai/pkg/logging"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/compress"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/favicon"
+	"github.com/gofiber/fiber/v2/middleware/helmet"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/pprof"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+)
+
+var levels = map[string]compress.Level{
+	config.CompressDisabled: compress.LevelDisabled,
+	config.CompressDefault:  compress.LevelDefault,
+	config.CompressSpeed:    compress.LevelBestSpeed,
+	config.CompressBest:     compress.LevelBestCompression,
+}
+
+// Use adds the middleware listed in c.Use to app, in order. The limiter
+// only applies to paths under apiBase and the logger writes to log.
+// pprof serves only the requests admin accepts, nil if there is no admin.
+func Use(app fiber.Router, c config.Middleware, apiBase string, log *logging.Logger, admin func(*fiber.Ctx) bool) error {
+	for _, name := range c.Use {
+		h, err := New(name, c, apiBase, log, admin)
+		if err != nil {
+			return err
+		}
+		app.Use(h)
+	}
+	return nil
+}
+
+// New creates the named middleware.
+func New(name string, c config.Middleware, apiBase string, log *logging.Logger, admin func(*fiber.Ctx) bool) (fiber.Handler, error) {
+	switch name {
+	case "favicon":
+		return favicon.New(favicon.Config{
+			File: c.Favicon.File,
+		}), nil
+	case "requestid":
+		return requestid.New(requestid.Config{
+			Header:     c.RequestID.Header,
+			ContextKey: "requestid",
+		}), nil
+	case "logger":
+		if log.Format != config.LogText {
+			return log.Access(), nil
+		}
+		return logger.New(logger.Config{
+			Format:     c.Logger.Format,
+			TimeFormat: c.Logger.TimeFormat,
+			Output:     log.Output,
+		}), nil
+	case "cors":
+		return cors.New(cors.Config{
+			AllowOrigins:     strings.Join(c.CORS.Origins, ","),
+			AllowMethods:     strings.Join(c.CORS.Methods, ","),
+			AllowHeaders:     strings.Join(c.CORS.Headers, ","),
+			ExposeHeaders:    strings.Join(c.CORS.Expose, ","),
+			AllowCredentials: c.CORS.Credentials,
+			MaxAge:           c.CORS.MaxAge,
+		}), nil
+	case "compress":
+		level, ok := levels[c.Compress.Level]
+		if !ok {
+			return nil, fmt.Errorf("middleware compress: unknown level %q", c.Compress.Level)
+		}
+		return compress.New(compress.Config{
+			Level: level,
+		}), nil
+	case "helmet":
+		h := c.Helmet
+		return helmet.New(helmet.Config{
+			ContentSecurityPolicy: h.ContentSecurityPolicy,
+			XFrameOptions:         h.XFrameOptions,
+			ReferrerPolicy:        h.ReferrerPolicy,
+			PermissionPolicy:      h.PermissionsPolicy,
+			HSTSMaxAge:            h.HSTSMaxAge,
+			HSTSPreloadEnabled:    h.HSTSPreload,
+			HSTSExcludeSubdomains: h.HSTSExcludeSubdomains,
+		}), nil
+	case "pprof":
+		if admin == nil {
+			return nil, fmt.Errorf("middleware pprof: requires admin.enabled")
+		}
+		prefix := strings.TrimSuffix(c.Pprof.Prefix, "/")
+		h := pprof.New(pprof.Config{
+			Prefix: prefix,
+		})
+		return func(c *fiber.Ctx) error {
+			if strings.HasPrefix(c.Path(), prefix+"/debug/pprof") && !admin(c) {
+				c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="mirai admin"`)
+				return fiber.ErrUnauthorized
+			}
+			return h(c)
+		}, nil
+	case "limiter":
+		l := c.Limiter
+		return limiter.New(limiter.Config{
+			Next: func(c *fiber.Ctx) bool {
+				return !strings.HasPrefix(c.Path(), apiBase)
+			},
+			Max:        l.Max,
+			Expiration: time.Duration(l.Dur) * time.Second,
+		}), nil
+	}
+	return nil, fmt.Errorf("unknown middleware %q", name)
+}
@@ -0,0 +1,92 @@
+// Package store is a fiber.Storage kept in a sqlite file, which can be
+// shared by every worker process and by the worker taking over on reload.
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// GCInterval is how often expired keys are deleted.
+var GCInterval = 10 * time.Minute
+
+type Storage struct {
+	db   *sql.DB
+	done chan struct{}
+}
+
+// New opens or creates the store in the sqlite file.
+func New(file string) (*Storage, error) {
+	// wal lets the workers read while one of them writes, busy_timeout
+	// waits for the lock of another worker instead of failing
+	db, err := sql.Open("sqlite3", "file:"+file+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS store (
+	k TEXT PRIMARY KEY,
+	v BLOB NOT NULL,
+	e INTEGER NOT NULL DEFAULT 0
+)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &Storage{db: db, done: make(chan struct{})}
+	go s.gc()
+	return s, nil
+}
+
+// Get returns the value of key, nil if it is missing or expired.
+func (s *Storage) Get(key string) ([]byte, error) {
+	var v []byte
+	err := s.db.QueryRow("SELECT v FROM store WHERE k = ? AND (e = 0 OR e > ?)", key, time.Now().Unix()).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return v, err
+}
+
+// Set stores val for key, expiring after exp unless it is 0.
+func (s *Storage) Set(key string, val []byte, exp time.Duration) error {
+	if key == "" || len(val) == 0 {
+		return nil
+	}
+	var e int64
+	if exp > 0 {
+		e = time.Now().Add(exp).Unix()
+	}
+	_, err := s.db.Exec("INSERT INTO store (k, v, e) VALUES (?, ?, ?) ON CONFLICT (k) DO UPDATE SET v = excluded.v, e = excluded.e", key, val, e)
+	return err
+}
+
+func (s *Storage) Delete(key string) error {
+	_, err := s.db.Exec("DELETE FROM store WHERE k = ?", key)
+	return err
+}
+
+func (s *Storage) Reset() error {
+	_, err := s.db.Exec("DELETE FROM store")
+	return err
+}
+
+func (s *Storage) Close() error {
+	close(s.done)
+	return s.db.Close()
+}
+
+func (s *Storage) gc() {
+	t := time.NewTicker(GCInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-t.C:
+			s.db.Exec("DELETE FROM store WHERE e != 0 AND e <= ?", now.Unix())
+		}
+	}
+}
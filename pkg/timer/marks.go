@@ -0,0 +1,74 @@
+package timer
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const localMarks = "timer_marks"
+
+// marks are the Server-Timing entries of a request. Entries with the same
+// name add up.
+type marks struct {
+	mu      sync.Mutex
+	entries []*mark
+}
+
+type mark struct {
+	name string
+	desc string
+	dur  time.Duration
+}
+
+// Marks collects the entries added by Mark and Add while serving a request
+// and writes them when it ends.
+func Marks() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		m := new(marks)
+		c.Locals(localMarks, m)
+		err := c.Next()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for _, e := range m.entries {
+			c.Append(fiber.HeaderServerTiming, entry(e.name, e.desc, e.dur))
+		}
+		return err
+	}
+}
+
+// Add adds d to the entry name. It does nothing outside of Marks.
+func Add(c *fiber.Ctx, name string, desc string, d time.Duration) {
+	m, ok := c.Locals(localMarks).(*marks)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.entries {
+		if e.name == name {
+			e.dur += d
+			return
+		}
+	}
+	m.entries = append(m.entries, &mark{name: name, desc: desc, dur: d})
+}
+
+// Mark starts timing the entry name. Calling the returned function stops it,
+// later calls do nothing.
+func Mark(c *fiber.Ctx, name string, desc string) func() {
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			Add(c, name, desc, time.Since(start))
+		})
+	}
+}
+
+// ValidName reports whether name is a token, as Server-Timing requires.
+func ValidName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\",;=()/<>?@[]{}:\\")
+}
@@ -32,20 +32,25 @@ func Print(name string, desc string, started ...bool) fiber.Handler {
 		if start.IsZero() {
 			start = c.Locals("timer").(time.Time)
 		}
-		timing := new(strings.Builder)
-		timing.WriteString(name)
-		if len(desc) != 0 {
-			timing.WriteString(";desc=")
-			timing.WriteByte('"')
-			timing.WriteString(desc)
-			timing.WriteByte('"')
-		}
-		timing.WriteString(";dur=")
-		timing.WriteString(fmt.Sprintf("%.02f", float64(stop.Sub(start).Microseconds())/1000))
-		c.Append(fiber.HeaderServerTiming, timing.String())
+		c.Append(fiber.HeaderServerTiming, entry(name, desc, stop.Sub(start)))
 		if !bstarted {
 			err = c.Next()
 		}
 		return err
 	}
 }
+
+// entry formats a Server-Timing entry.
+func entry(name string, desc string, d time.Duration) string {
+	timing := new(strings.Builder)
+	timing.WriteString(name)
+	if len(desc) != 0 {
+		timing.WriteString(";desc=")
+		timing.WriteByte('"')
+		timing.WriteString(desc)
+		timing.WriteByte('"')
+	}
+	timing.WriteString(";dur=")
+	timing.WriteString(fmt.Sprintf("%.02f", float64(d.Microseconds())/1000))
+	return timing.String()
+}
@@ -0,0 +1,298 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudwindy/mirai/pkg/config"
+)
+
+// Batching of exported spans.
+var (
+	BatchSize     = 512
+	QueueSize     = 4096
+	FlushInterval = 2 * time.Second
+)
+
+// Tracer creates spans and exports the sampled ones in batches.
+type Tracer struct {
+	service string
+	ratio   float64
+	exp     exporter
+
+	mu   sync.Mutex
+	rand *mrand.Rand
+
+	queue chan *Span
+	stop  chan struct{}
+	done  chan struct{}
+	// called when an export fails
+	onError func(error)
+}
+
+type exporter interface {
+	export(body []byte) error
+	close() error
+}
+
+// New creates a tracer exporting to the collector or file in c. onError is
+// called when an export fails.
+func New(c config.Trace, onError func(error)) (*Tracer, error) {
+	t := &Tracer{
+		onError: onError,
+		service: c.Service,
+		ratio:   c.Sample,
+		rand:    newRand(),
+		queue:   make(chan *Span, QueueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	switch c.Exporter {
+	case config.TraceOTLP:
+		t.exp = &otlpExporter{
+			endpoint: c.Endpoint,
+			headers:  c.Headers,
+			client:   &http.Client{Timeout: 10 * time.Second},
+		}
+	case config.TraceFile:
+		f, err := os.OpenFile(c.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		t.exp = &fileExporter{f: f}
+	default:
+		return nil, fmt.Errorf("trace: unknown exporter %q", c.Exporter)
+	}
+	go t.run()
+	return t, nil
+}
+
+// export queues s, dropping it if the queue is full.
+func (t *Tracer) export(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.flush(batch); err != nil && t.onError != nil {
+			t.onError(err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+				if len(batch) >= BatchSize {
+					flush()
+				}
+			}
+			flush()
+			return
+		}
+	}
+}
+
+func (t *Tracer) flush(batch []*Span) error {
+	body, err := json.Marshal(t.request(batch))
+	if err != nil {
+		return err
+	}
+	return t.exp.export(body)
+}
+
+// Close exports the queued spans. Spans ended afterwards are lost.
+func (t *Tracer) Close() error {
+	close(t.stop)
+	<-t.done
+	return t.exp.close()
+}
+
+// OTLP/JSON export request, see opentelemetry-proto.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              Kind           `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpStatus struct {
+		// 0 unset, 2 error
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+	}
+)
+
+func (t *Tracer) request(batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = s.otlp()
+	}
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{keyValue("service.name", t.service)},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "mirai"},
+				Spans: spans,
+			}},
+		}},
+	}
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceID:           s.TraceID.String(),
+		SpanID:            s.SpanID.String(),
+		Name:              s.Name,
+		Kind:              s.Kind,
+		StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+	}
+	if s.Parent != (SpanID{}) {
+		o.ParentSpanID = s.Parent.String()
+	}
+	keys := make([]string, 0, len(s.Attrs))
+	for k := range s.Attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o.Attributes = append(o.Attributes, keyValue(k, s.Attrs[k]))
+	}
+	if s.Error != "" {
+		o.Status = otlpStatus{Code: 2, Message: s.Error}
+	}
+	return o
+}
+
+func keyValue(key string, v any) otlpKeyValue {
+	var val otlpValue
+	switch v := v.(type) {
+	case string:
+		val.StringValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		val.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		val.IntValue = &s
+	case float64:
+		val.DoubleValue = &v
+	case bool:
+		val.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		val.StringValue = &s
+	}
+	return otlpKeyValue{Key: key, Value: val}
+}
+
+// otlpExporter posts spans to an OTLP/HTTP collector.
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+func (e *otlpExporter) export(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return errors.New("trace: collector responded " + resp.Status)
+	}
+	return nil
+}
+
+func (e *otlpExporter) close() error {
+	return nil
+}
+
+// fileExporter appends one export request per line.
+type fileExporter struct {
+	f *os.File
+}
+
+func (e *fileExporter) export(body []byte) error {
+	_, err := e.f.Write(append(body, '\n'))
+	return err
+}
+
+func (e *fileExporter) close() error {
+	return e.f.Close()
+}
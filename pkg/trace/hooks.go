@@ -0,0 +1,93 @@
+package trace
+
+import (
+	"net/http"
+	"strings"
+
+	lhttp "github.com/cloudwindy/mirai/lib/http"
+	"github.com/cloudwindy/mirai/lib/odbc"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// HeaderTraceParent is the W3C trace context header.
+const HeaderTraceParent = "traceparent"
+
+// Middleware starts a server span for every request, continuing the trace
+// of an incoming traceparent header. The span is put in the user context.
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if Default == nil {
+			return c.Next()
+		}
+		// strings of the request are only valid until it ends
+		method := strings.Clone(c.Method())
+		parent, _ := ParseTraceParent(c.Get(HeaderTraceParent))
+		ctx, span := Default.StartRemote(c.UserContext(), parent, method, KindServer)
+		c.SetUserContext(ctx)
+		err := c.Next()
+
+		route := c.Route().Path
+		span.Name = method + " " + route
+		status := c.Response().StatusCode()
+		if ferr, ok := err.(*fiber.Error); ok {
+			status = ferr.Code
+		} else if err != nil {
+			status = fiber.StatusInternalServerError
+		}
+		span.SetAttr("http.method", method)
+		span.SetAttr("http.route", route)
+		span.SetAttr("http.target", strings.Clone(c.OriginalURL()))
+		span.SetAttr("http.status_code", status)
+		span.SetAttr("net.peer.ip", c.IP())
+		if id, ok := c.Locals("requestid").(string); ok {
+			span.SetAttr("request.id", id)
+		}
+		span.SetError(err)
+		if err == nil && status >= fiber.StatusInternalServerError {
+			span.Error = utils.StatusMessage(status)
+		}
+		span.End()
+		return err
+	}
+}
+
+// ObserveDB records a span for a database statement, see odbc.AddHook.
+func ObserveDB(ev odbc.Event) {
+	if Default == nil || SpanFromContext(ev.Context) == nil {
+		return
+	}
+	_, span := Default.Start(ev.Context, "db "+ev.Op, KindClient)
+	span.StartTime = ev.Start
+	span.SetAttr("db.operation", ev.Op)
+	span.SetAttr("db.statement", ev.Query)
+	if ev.Rows >= 0 {
+		span.SetAttr("db.rows", ev.Rows)
+	}
+	span.SetError(ev.Err)
+	span.EndAt(ev.Start.Add(ev.Duration))
+}
+
+// HTTPClient records a span for an outgoing request and sends the
+// traceparent header, see the Use function of lib/http.
+func HTTPClient(req *http.Request, next lhttp.Sender) (*http.Response, error) {
+	if Default == nil || SpanFromContext(req.Context()) == nil {
+		return next(req)
+	}
+	_, span := Default.Start(req.Context(), "HTTP "+req.Method, KindClient)
+	defer span.End()
+	req = req.Clone(req.Context())
+	req.Header.Set(HeaderTraceParent, span.TraceParent())
+	span.SetAttr("http.method", req.Method)
+	span.SetAttr("http.url", req.URL.Redacted())
+	resp, err := next(req)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetAttr("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.Error = resp.Status
+	}
+	return resp, nil
+}
@@ -0,0 +1,226 @@
+// Package trace records request spans, propagates W3C traceparent headers
+// and exports spans in the OTLP/HTTP JSON format.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	mrand "math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, as numbered by OTLP.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// SpanContext identifies a span across processes.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// TraceParent formats sc as a traceparent header.
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceParent parses a traceparent header.
+func ParseTraceParent(s string) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// Span is a timed operation. Spans that are not sampled are still
+// propagated but never exported. A nil span ignores every call.
+type Span struct {
+	SpanContext
+	Parent    SpanID
+	Name      string
+	Kind      Kind
+	StartTime time.Time
+	EndTime   time.Time
+	Attrs     map[string]any
+	// error message, empty if the span succeeded
+	Error string
+
+	tracer *Tracer
+	mu     sync.Mutex
+	ended  bool
+}
+
+// SetAttr sets an attribute of the span.
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attrs[key] = value
+}
+
+// SetError marks the span failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = err.Error()
+}
+
+// End ends the span now.
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt ends the span at t and queues it for export.
+func (s *Span) EndAt(t time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = t
+	s.mu.Unlock()
+	if s.Sampled {
+		s.tracer.export(s)
+	}
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a context carrying s.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFromContext returns the span carried by ctx, nil if there is none.
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Default is the tracer used by the package functions, nil if tracing is
+// disabled.
+var Default *Tracer
+
+// Start starts a span on the default tracer. It returns ctx and a nil span
+// if tracing is disabled.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	if Default == nil {
+		return ctx, nil
+	}
+	return Default.Start(ctx, name, kind)
+}
+
+// Start starts a span, a child of the span in ctx if any.
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	var parent SpanContext
+	if p := SpanFromContext(ctx); p != nil {
+		parent = p.SpanContext
+	}
+	s := t.newSpan(parent, name, kind)
+	return ContextWithSpan(ctx, s), s
+}
+
+// StartRemote starts a span continuing the trace of a remote parent, which
+// may be invalid to start a new trace.
+func (t *Tracer) StartRemote(ctx context.Context, parent SpanContext, name string, kind Kind) (context.Context, *Span) {
+	s := t.newSpan(parent, name, kind)
+	return ContextWithSpan(ctx, s), s
+}
+
+func (t *Tracer) newSpan(parent SpanContext, name string, kind Kind) *Span {
+	s := &Span{
+		Name:      name,
+		Kind:      kind,
+		StartTime: time.Now(),
+		Attrs:     make(map[string]any),
+		tracer:    t,
+	}
+	if parent.IsValid() {
+		s.TraceID = parent.TraceID
+		s.Parent = parent.SpanID
+		s.Sampled = parent.Sampled
+	} else {
+		randomID(s.TraceID[:])
+		s.Sampled = t.sample()
+	}
+	randomID(s.SpanID[:])
+	return s
+}
+
+func (t *Tracer) sample() bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rand.Float64() < t.ratio
+}
+
+func randomID(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("trace: random id: %v", err))
+	}
+}
+
+func newRand() *mrand.Rand {
+	var seed [8]byte
+	randomID(seed[:])
+	return mrand.New(mrand.NewSource(int64(binary.LittleEndian.Uint64(seed[:]))))
+}
@@ -1,6 +1,15 @@
 -- These is a reasonable Mirai Server manifest file.
 -- Change them if you need to.
+--
+-- Profiles: `mirai --profile prod` (or MIRAI_PROFILE=prod) merges
+-- project.prod.lua over this file and reads .env.prod after .env.
+-- Any key can be overridden from the environment or .env files with
+-- MIRAI_<KEY>, e.g. MIRAI_DB_CONN for db.conn, MIRAI_LISTENERS_1_LISTEN
+-- for listeners[1].listen or MIRAI_DATABASES_CACHE_CONN for
+-- databases.cache.conn.
 return {
+  -- version: your project version, shown by `mirai status`
+  version = '0.1.0',
   -- index: your main lua file
   --        '.' looks for index.lua in the current directory
   index = '.',
@@ -8,32 +17,256 @@ return {
   root = './static',
   -- listen: if you want to go public, listen on "0.0.0.0:80"
   listen = ':80',
+  -- listeners: replaces listen when you need more than one listener
+  --   type: http (default), https, redirect (to https) or unix
+  --   listen: address, or socket path for unix
+  --   cert, key: https certificate, reloaded when the files change
+  --   certs: more https certificates, chosen by SNI
+  --   to: redirect target, defaults to https on the requested host
+  -- listeners = {
+  --   { listen = ':80', type = 'redirect' },
+  --   { listen = ':443', type = 'https', cert = 'cert.pem', key = 'key.pem' },
+  --   { listen = '/run/mirai.sock', type = 'unix' },
+  -- },
   -- api_base: where's your api endpoint
   api_base = '/api',
   -- admin_base: where's your admin endpoint
   admin_base = '/admin',
   -- data_path: databases path
   data_path = './data',
-  -- editing: allow remote editing
-  --          this is currently too dangerous to use
-  editing = false,
+  -- control: control socket used by `mirai reload`, `mirai stop` and
+  --          `mirai status`, defaults to mirai-<hash of the project path>.sock
+  --          in the temp directory
+  control = nil,
+  -- workers: number of worker processes sharing the listener
+  --          crashed workers are restarted with backoff
+  workers = 1,
+  -- drain: seconds to wait for in-flight requests on stop and reload
+  drain = 10,
+  -- ready_timeout: seconds to wait for a reloaded worker to become ready
+  --                the old worker keeps serving if the new one fails
+  ready_timeout = 30,
+
+  restart = {
+    -- restart.min_backoff, restart.max_backoff: delay in seconds before
+    --                     restarting a crashed worker, doubled on each crash
+    min_backoff = 0.1,
+    max_backoff = 30,
+    -- restart.max_restarts: give up after this many crashes within window
+    --                       seconds, -1 to never give up
+    max_restarts = 10,
+    window = 60,
+    -- restart.log: append crash records to this file
+    log = './data/crash.log',
+    -- restart.on_crash: lua script to run on crash, gets the global `crash`
+    on_crash = nil,
+  },
 
   db = {
-    -- db.driver: supports mysql, postgres and sqlite3
+    -- db.driver: supports mysql, postgres and sqlite3, defaults to sqlite3
     driver = 'sqlite3',
     -- db.conn: connection string
     conn = ':memory:',
     -- db.sql_path: your sql files path
     sql_path = './sql',
+    -- db.max_connections: open connections, 0 for no limit, 1 for in-memory sqlite
+    --                     whose tables exist once per connection
+    max_connections = 0,
+    -- db.max_idle: idle connections kept open, 0 for 2, -1 for none
+    max_idle = 0,
+    -- db.conn_max_lifetime, db.conn_max_idle_time: seconds before a connection
+    --                                             is closed, 0 for no limit
+    conn_max_lifetime = 0,
+    conn_max_idle_time = 0,
+    -- db.ping: fail to start if the database cannot be reached
+    ping = false,
+    -- db.timeout: seconds a call may run, 0 for no limit, a query may set its own
+    --             with db:rows({'select ...', timeout = 30})
+    --             calls made by a request are also canceled when its client
+    --             disconnects, errors start with 'db timeout' or 'db canceled'
+    timeout = 0,
+    -- db.types: how column values are returned to lua, a query may also
+    --           pass them as db:rows({'select ...', time = 'unix'})
+    types = {
+      -- db.types.time: rfc3339 strings, unix seconds or table (os.date('*t') fields)
+      time = 'rfc3339',
+      -- db.types.decimal: string keeps the exact value, or number
+      decimal = 'string',
+      -- db.types.json: table decodes json columns, or string
+      json = 'table',
+      -- db.types.bigint: string keeps integers beyond 2^53 exact, or number
+      bigint = 'string',
+    },
+    -- db.migrations: versioned schema changes, managed by `mirai migrate up|down|status|create`
+    migrations = {
+      -- db.migrations.path: directory of <version>_<name>.up.sql and .down.sql files,
+      --                     or .lua scripts that run with the transaction in the global tx;
+      --                     on mysql sql files need multiStatements=true in db.conn, and
+      --                     schema changes commit implicitly, so keep one per migration
+      path = './migrations',
+      -- db.migrations.table: history of the applied versions
+      table = 'schema_migrations',
+      -- db.migrations.auto: apply pending migrations in one transaction before starting,
+      --                     in every worker for an in-memory sqlite database
+      auto = false,
+    },
+  },
+
+  -- databases: more connections, each configured like db and available as db.<name>
+  --            databases.main is used as db if db is not set; reader, writer and
+  --            sqlpath are reserved
+  databases = {
+    -- replica = {
+    --   driver = 'postgres',
+    --   conn = 'postgres://reader@replica/app',
+    --   -- databases.<name>.role: primary, or replica to be returned by db:reader(),
+    --   --                        db:writer() always returns db
+    --   role = 'replica',
+    --   max_connections = 10,
+    -- },
+  },
+
+  log = {
+    -- log.format: text, json or logfmt
+    --             text keeps the access log format of middleware.logger,
+    --             json and logfmt write structured access records
+    format = 'text',
+    -- log.level: debug, info, warn or error
+    level = 'info',
+    -- log.file: log file, stdout if unset
+    file = nil,
+    -- log.max_size: rotate the file at this size in megabytes, 0 to never rotate
+    max_size = 0,
+    -- log.max_files: rotated files to keep
+    max_files = 5,
+    -- log.slow_query: log database statements taking longer than this many
+    --                 seconds with the request id, 0 to log none
+    --                 db:on('query', fn) gets every statement of a database
+    slow_query = 0,
+  },
+
+  metrics = {
+    -- metrics.enabled: serve prometheus metrics on api_base..admin_base..path
+    --                  every worker keeps its own metrics
+    enabled = false,
+    path = '/metrics',
+    -- metrics.public: serve without authentication, otherwise scrapers send
+    --                 `Authorization: Bearer <token>` with an admin token
+    public = false,
   },
 
-  limiter = {
-    -- limiter.enabled: enable limiter middleware for api_base
-    --                  this will be moved to middleware config later
+  trace = {
+    -- trace.enabled: record spans for requests, lua handlers, db statements
+    --                and http client calls, traceparent headers are honored
+    --                and sent
     enabled = false,
-    -- limiter.max: maximum requests of a single ip
-    max = 100,
-    -- limiter.dur: how long to keep each record (in seconds)
-    dur = 1,
-  }
+    -- trace.service: service name reported to the collector
+    service = 'mirai',
+    -- trace.exporter: otlp posts OTLP/HTTP json to endpoint,
+    --                 file appends one export request per line to file
+    exporter = 'otlp',
+    endpoint = 'http://localhost:4318/v1/traces',
+    headers = {},
+    file = nil,
+    -- trace.sample: fraction of new traces to record, 0 for none
+    sample = 1,
+  },
+
+  admin = {
+    -- admin.enabled: serve the admin api on api_base..admin_base:
+    --                GET/PUT/DELETE /files/<path>, GET /files, POST /reload,
+    --                GET /logs?lines=n and GET /config
+    --                `editing = true` of older manifests enables it too
+    enabled = false,
+    -- admin.tokens: accepted `Authorization: Bearer <token>` tokens,
+    --               at least 16 characters
+    tokens = {},
+    -- admin.client_ca: also accept client certificates verified by this CA
+    --                  on https listeners
+    client_ca = nil,
+    -- admin.root: directory managed by /files, defaults to index or its
+    --             directory
+    root = nil,
+    -- admin.backups: previous versions kept in root/.backups of every file
+    --                written or deleted, -1 for none
+    backups = 5,
+    -- admin.console: serve the web console at api_base..admin_base/console
+    --                with live requests, routes, stats, read-only sql and a
+    --                file editor, sign in with a token or client certificate
+    console = false,
+  },
+
+  health = {
+    -- health.enabled: serve liveness and readiness probes at the root,
+    --                 ready once index has run and app:start succeeded
+    --                 add checks with app:healthcheck(name, fn)
+    enabled = false,
+    live = '/healthz',
+    -- health.ready: responds 503 while any check fails
+    ready = '/readyz',
+    -- health.timeout: seconds allowed for the checks
+    timeout = 5,
+    -- health.shutdown_delay: seconds to report not ready before shutting
+    --                        down
+    shutdown_delay = 0,
+  },
+
+  middleware = {
+    -- middleware.use: built-in middleware to enable, in order
+    --                 available: favicon, requestid, logger, cors, compress,
+    --                 helmet, pprof and limiter
+    use = { 'favicon', 'requestid', 'logger', 'cors', 'compress' },
+    -- middleware.body_limit: maximum request body size in bytes
+    body_limit = 4 * 1024 * 1024,
+    favicon = {
+      -- favicon.file: icon to serve, empty for none
+      file = nil,
+    },
+    requestid = {
+      header = 'X-Request-ID',
+    },
+    logger = {
+      format = '[${time}] ${status} - ${latency} ${method} ${path}\n',
+      time_format = '15:04:05',
+    },
+    cors = {
+      -- cors.origins: allowed origins, defaults to any
+      origins = { '*' },
+      methods = { 'GET', 'POST', 'HEAD', 'PUT', 'DELETE', 'PATCH' },
+      headers = {},
+      expose = {},
+      -- cors.credentials: requires explicit origins
+      credentials = false,
+      -- cors.max_age: seconds to cache preflight results
+      max_age = 0,
+    },
+    compress = {
+      -- compress.level: disabled, default, speed or best
+      level = 'default',
+    },
+    -- security headers, unset values keep the defaults
+    helmet = {
+      content_security_policy = nil,
+      x_frame_options = 'SAMEORIGIN',
+      referrer_policy = 'no-referrer',
+      permissions_policy = nil,
+      hsts_max_age = 0,
+      hsts_preload = false,
+      hsts_exclude_subdomains = false,
+    },
+    pprof = {
+      -- pprof.prefix: serves <prefix>/debug/pprof, defaults to api_base..admin_base
+      --               requires admin.enabled, only admins may fetch profiles
+      prefix = nil,
+    },
+    limiter = {
+      -- limiter.enabled: enable limiter middleware for api_base
+      --                  same as adding 'limiter' to use
+      enabled = false,
+      -- limiter.max: maximum requests of a single ip
+      max = 100,
+      -- limiter.dur: how long to keep each record (in seconds)
+      dur = 1,
+    },
+  },
 }